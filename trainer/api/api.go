@@ -25,8 +25,11 @@ import (
 	"orca/trainer/cloud"
 	"orca/trainer/configuration"
 	"orca/trainer/model"
+	"orca/trainer/planner"
+	"orca/trainer/schedule"
 	"orca/trainer/state"
 	log "orca/util/log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,10 +41,26 @@ type Api struct {
 	configurationStore *configuration.ConfigurationStore
 	state              *state.StateStore
 	cloudProvider      *cloud.CloudProvider
+	planner            *planner.BoringPlanner
 
 	sessions map[string]bool
 }
 
+type ApplicationStatus struct {
+	*model.ApplicationConfiguration
+
+	/* Dependencies holding back deployment of this application */
+	WaitingOn []string
+}
+
+/* The same schedule as entered in its own timezone and as UTC slots for the coming week */
+type ScheduleView struct {
+	Timezone string
+	Local    schedule.WeekdayBased
+	Utc      schedule.WeekdayBased
+	Current  int
+}
+
 type Logs struct {
 	StdOut string
 	StdErr string
@@ -49,10 +68,11 @@ type Logs struct {
 
 var ApiLogger = log.LoggerWithField(log.Logger, "module", "api")
 
-func (api *Api) Init(port int, configurationStore *configuration.ConfigurationStore, state *state.StateStore, cloudProvider *cloud.CloudProvider) {
+func (api *Api) Init(port int, configurationStore *configuration.ConfigurationStore, state *state.StateStore, cloudProvider *cloud.CloudProvider, plannerEngine *planner.BoringPlanner) {
 	api.configurationStore = configurationStore
 	api.state = state
 	api.cloudProvider = cloudProvider
+	api.planner = plannerEngine
 	api.sessions = make(map[string]bool)
 
 	ApiLogger.Infof("Initializing Api on Port %d", port)
@@ -66,15 +86,30 @@ func (api *Api) Init(port int, configurationStore *configuration.ConfigurationSt
 	r.HandleFunc("/config/applications", api.getAllConfigurationApplications)
 	r.HandleFunc("/config/applications/status", api.getAllConfigurationApplications_Status)
 	r.HandleFunc("/config/applications/configuration/latest", api.getAllConfigurationApplications_Configurations_Latest)
+	r.HandleFunc("/config/applications/configuration/mark", api.markApplicationConfigurationVersion)
+	r.HandleFunc("/config/applications/schedule", api.getApplicationSchedule)
+	r.HandleFunc("/config/applications/schedule/render", api.renderApplicationSchedule)
 	r.HandleFunc("/state", api.getAllRunningState)
 	r.HandleFunc("/checkin", api.hostCheckin)
 
 	r.HandleFunc("/state/cloud/host/performance", api.getHostPerformance)
 	r.HandleFunc("/state/cloud/host/terminate", api.terminateHost)
+	r.HandleFunc("/state/cloud/host/labels", api.hostLabels)
+	r.HandleFunc("/state/cloud/host/cordon", api.cordonHost)
+	r.HandleFunc("/state/cloud/host/uncordon", api.uncordonHost)
+	r.HandleFunc("/state/cloud/host/drain", api.drainHost)
 	r.HandleFunc("/state/cloud/host/latest/performance", api.getHostLatestPerformance)
 	r.HandleFunc("/state/cloud/application/performance", api.getAppPerformance)
 	r.HandleFunc("/state/cloud/application/host/performance", api.getAppHostPerformance)
 
+	r.HandleFunc("/planner/history", api.getPlannerHistory)
+	r.HandleFunc("/planner/explain", api.explainApplication)
+	r.HandleFunc("/planner/snapshot", api.getPlannerSnapshot)
+
+	r.HandleFunc("/jobs", api.getJobs)
+	r.HandleFunc("/jobs/run", api.runJob)
+	r.HandleFunc("/jobs/logs", api.getJobRunLogs)
+
 	r.HandleFunc("/state/cloud/audit", api.getAudit)
 	r.HandleFunc("/state/cloud/host/audit", api.getHostAudit)
 	r.HandleFunc("/state/cloud/application/audit", api.getApplicationAudit)
@@ -120,20 +155,37 @@ func (api *Api) getAllConfiguration(w http.ResponseWriter, r *http.Request) {
 
 func (api *Api) getAllConfigurationApplications_Status(w http.ResponseWriter, r *http.Request) {
 	if api.authenticate_user(w, r) {
-		listOfApplications := []*model.ApplicationConfiguration{}
+		listOfApplications := []ApplicationStatus{}
 		for _, application := range api.configurationStore.GetAllConfiguration() {
 			var app_stats = &model.ApplicationConfiguration{}
 			app_stats.Name = application.Name
+			app_stats.Type = application.Type
+			app_stats.Job = application.Job
+			app_stats.Cron = application.Cron
 			app_stats.MinDeployment = application.MinDeployment
 			app_stats.DesiredDeployment = application.DesiredDeployment
+			app_stats.MaxDeployment = application.MaxDeployment
 			app_stats.DisableSchedule = application.DisableSchedule
 			app_stats.DeploymentSchedule = application.DeploymentSchedule
+			app_stats.MinSchedule = application.MinSchedule
+			app_stats.Maintenance = application.Maintenance
 			app_stats.ScheduleParts = application.ScheduleParts
 			app_stats.Enabled = application.Enabled
 			app_stats.Publish = application.Publish
+			app_stats.AutoRollback = application.AutoRollback
 			app_stats.PropertyGroups = application.PropertyGroups
 			app_stats.Depends = application.Depends
-			listOfApplications = append(listOfApplications, app_stats)
+			app_stats.Spread = application.Spread
+			app_stats.AntiAffinity = application.AntiAffinity
+			app_stats.Autoscale = application.Autoscale
+			app_stats.QueueAutoscale = application.QueueAutoscale
+			app_stats.Priority = application.Priority
+			app_stats.PreScale = application.PreScale
+			app_stats.SpotPolicy = application.SpotPolicy
+			listOfApplications = append(listOfApplications, ApplicationStatus{
+				ApplicationConfiguration: app_stats,
+				WaitingOn:                planner.UnsatisfiedDependencies(application, *api.configurationStore, api.state),
+			})
 		}
 		returnJson(w, listOfApplications)
 	}
@@ -147,6 +199,62 @@ func (api *Api) getAllConfigurationApplications(w http.ResponseWriter, r *http.R
 			var object model.ApplicationConfiguration
 			decoder := json.NewDecoder(r.Body)
 			if err := decoder.Decode(&object); err == nil {
+				if err := api.configurationStore.ValidateDependencies(applicationName, object.Depends); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if err := object.SpotPolicy.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if object.Type != model.APPLICATION__SERVICE && object.Type != model.APPLICATION__JOB && object.Type != model.APPLICATION__DAEMON {
+					http.Error(w, "Unknown application type "+object.Type, 400)
+					return
+				}
+
+				if err := object.Job.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if err := object.Cron.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if !object.Cron.IsEmpty() && !object.IsJob() {
+					http.Error(w, "Only jobs can have a cron schedule", 400)
+					return
+				}
+
+				if err := object.ValidateDeploymentLimits(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				/* Parts replace the grid, so the grid is only checked once they are compiled */
+				if err := object.CompileSchedule(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if err := object.DeploymentSchedule.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if err := object.MinSchedule.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
+				if err := object.Maintenance.Validate(); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+
 				application, err := api.configurationStore.GetConfiguration(applicationName)
 				if err != nil {
 					object.Config = make(map[string]*model.VersionConfig)
@@ -158,14 +266,35 @@ func (api *Api) getAllConfigurationApplications(w http.ResponseWriter, r *http.R
 					AppId:   applicationName,
 				})
 
+				application.Type = object.Type
+				application.Job = object.Job
+				/* The trainer owns LastScheduleTime, a changed schedule starts counting again */
+				previousCron := application.Cron
+				application.Cron = object.Cron
+				application.Cron.LastScheduleTime = time.Time{}
+				if object.Cron.Trigger() == previousCron.Trigger() {
+					application.Cron.LastScheduleTime = previousCron.LastScheduleTime
+				}
 				application.MinDeployment = object.MinDeployment
 				application.DesiredDeployment = object.DesiredDeployment
+				application.MaxDeployment = object.MaxDeployment
 				application.Enabled = object.Enabled
 				application.DisableSchedule = object.DisableSchedule
 				application.DeploymentSchedule = object.DeploymentSchedule
+				application.MinSchedule = object.MinSchedule
+				application.Maintenance = object.Maintenance
 				application.PropertyGroups = object.PropertyGroups
 				application.ScheduleParts = object.ScheduleParts
 				application.Depends = object.Depends
+				application.AutoRollback = object.AutoRollback
+				application.Spread = object.Spread
+				application.AntiAffinity = object.AntiAffinity
+				application.Autoscale = object.Autoscale
+				application.QueueAutoscale = object.QueueAutoscale
+				application.Priority = object.Priority
+				application.SpotPolicy = object.SpotPolicy
+				application.PreScale.LeadTime = object.PreScale.LeadTime
+				application.PreScale.Learn = object.PreScale.Learn
 				api.persistConfiguration()
 			}
 		} else if r.Method == "DELETE" {
@@ -218,6 +347,111 @@ func (api *Api) getAllConfigurationApplications_Configurations_Latest(w http.Res
 	}
 }
 
+func (api *Api) getApplicationSchedule(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		applicationName := r.URL.Query().Get("application")
+		application, err := api.configurationStore.GetConfiguration(applicationName)
+		if err != nil {
+			http.Error(w, "Could not find application", 404)
+			return
+		}
+
+		now := time.Now()
+		returnJson(w, ScheduleView{
+			Timezone: application.DeploymentSchedule.Timezone,
+			Local:    application.DeploymentSchedule.LocalView(now),
+			Utc:      application.DeploymentSchedule.UtcView(now),
+			Current:  application.DeploymentSchedule.Get(now),
+		})
+	}
+}
+
+/* Effective desired counts between from and to (RFC3339), every step minutes or at the schedules resolution */
+func (api *Api) renderApplicationSchedule(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		applicationName := r.URL.Query().Get("application")
+		application, err := api.configurationStore.GetConfiguration(applicationName)
+		if err != nil {
+			http.Error(w, "Could not find application", 404)
+			return
+		}
+
+		from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "from must be an RFC3339 time", 400)
+			return
+		}
+
+		to, err := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "to must be an RFC3339 time", 400)
+			return
+		}
+
+		step := 0
+		if r.URL.Query().Get("step") != "" {
+			step, err = strconv.Atoi(r.URL.Query().Get("step"))
+			if err != nil || step <= 0 {
+				http.Error(w, "step must be a positive number of minutes", 400)
+				return
+			}
+		}
+
+		points, err := application.DeploymentSchedule.Render(from, to, time.Duration(step)*time.Minute)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		returnJson(w, points)
+	}
+}
+
+func (api *Api) markApplicationConfigurationVersion(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		applicationName := r.URL.Query().Get("application")
+		application, err := api.configurationStore.GetConfiguration(applicationName)
+		if err != nil {
+			http.Error(w, "Could not find application", 404)
+			return
+		}
+
+		if r.Method == "POST" {
+			version := r.URL.Query().Get("version")
+			versionConfig, ok := application.PublishedConfig[version]
+			if !ok {
+				http.Error(w, "Could not find published version", 404)
+				return
+			}
+
+			mark := r.URL.Query().Get("state")
+			if mark == "bad" {
+				versionConfig.KnownBad = true
+				versionConfig.KnownGood = false
+			} else if mark == "good" {
+				versionConfig.KnownBad = false
+				versionConfig.KnownGood = true
+				versionConfig.RollbackHandled = false
+			} else if mark == "unknown" {
+				versionConfig.KnownBad = false
+				versionConfig.KnownGood = false
+				versionConfig.RollbackHandled = false
+			} else {
+				http.Error(w, "state must be one of bad, good or unknown", 400)
+				return
+			}
+
+			state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+				Message: fmt.Sprintf("API: Version %s of application %s was marked as %s", version, applicationName, mark),
+				AppId:   applicationName,
+			})
+
+			api.persistConfiguration()
+		}
+
+		returnJson(w, application.PublishedConfig)
+	}
+}
+
 func (api *Api) getAllRunningState(w http.ResponseWriter, r *http.Request) {
 	if api.authenticate_user(w, r) {
 		returnJson(w, api.state.GetAllHosts())
@@ -249,6 +483,8 @@ func (api *Api) hostCheckin(w http.ResponseWriter, r *http.Request) {
 			}
 			ip, subnet, secGrps, isSpot, spotId, instanceType := api.cloudProvider.Engine.GetHostInfo(cloud.HostId(hostId))
 			host.GroupingTag = api.cloudProvider.Engine.GetTag("GroupingTag", host.Id)
+			host.Labels = api.cloudProvider.GetHostLabels(host.Id, api.configurationStore.GetPlacementLabelKeys())
+			host.Cordoned, host.Draining = api.cloudProvider.GetHostMaintenance(host.Id)
 
 			host.Ip = ip
 			host.Network = subnet
@@ -417,6 +653,167 @@ func (api *Api) terminateHost(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (api *Api) setHostMaintenance(w http.ResponseWriter, r *http.Request, cordoned bool, draining bool, action string) {
+	if api.authenticate_user(w, r) {
+		if r.Method != "POST" {
+			http.Error(w, "Hosts are "+action+" with a POST", 405)
+			return
+		}
+
+		hostId := r.URL.Query().Get("host")
+		host, err := api.state.GetConfiguration(hostId)
+		if err != nil {
+			http.Error(w, "Could not find host", 404)
+			return
+		}
+
+		api.cloudProvider.SetHostMaintenance(host.Id, cordoned, draining)
+		host.Cordoned = cordoned
+		host.Draining = draining
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+			Message: fmt.Sprintf("API: Host %s was %s", host.Id, action),
+			HostId:  host.Id,
+		})
+		returnJson(w, host)
+	}
+}
+
+func (api *Api) cordonHost(w http.ResponseWriter, r *http.Request) {
+	api.setHostMaintenance(w, r, true, false, "cordoned")
+}
+
+func (api *Api) uncordonHost(w http.ResponseWriter, r *http.Request) {
+	api.setHostMaintenance(w, r, false, false, "uncordoned")
+}
+
+func (api *Api) drainHost(w http.ResponseWriter, r *http.Request) {
+	api.setHostMaintenance(w, r, true, true, "set to drain")
+}
+
+func (api *Api) hostLabels(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		hostId := r.URL.Query().Get("host")
+		host, err := api.state.GetConfiguration(hostId)
+		if err != nil {
+			http.Error(w, "Could not find host", 404)
+			return
+		}
+
+		if r.Method == "POST" {
+			var labels map[string]string
+			decoder := json.NewDecoder(r.Body)
+			if err := decoder.Decode(&labels); err != nil {
+				http.Error(w, "Labels must be a json object of strings", 400)
+				return
+			}
+
+			/* Clear the tags of any labels that were dropped */
+			removed := make(map[string]string)
+			for key := range host.Labels {
+				if _, ok := labels[key]; !ok {
+					removed[key] = ""
+				}
+			}
+			api.cloudProvider.SetHostLabels(host.Id, removed)
+			api.cloudProvider.SetHostLabels(host.Id, labels)
+			host.Labels = labels
+
+			state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+				Message: fmt.Sprintf("API: Labels of host %s set to %+v", host.Id, labels),
+				HostId:  host.Id,
+			})
+		}
+
+		returnJson(w, host.Labels)
+	}
+}
+
+func (api *Api) getPlannerHistory(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		returnJson(w, api.planner.History())
+	}
+}
+
+func (api *Api) getPlannerSnapshot(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		snapshot, err := api.planner.Snapshot(*api.configurationStore, *api.state)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		returnJson(w, snapshot)
+	}
+}
+
+func (api *Api) explainApplication(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		application := r.URL.Query().Get("application")
+		returnJson(w, api.planner.Explain(application))
+	}
+}
+
+/* Jobs with their runs, oldest first, optionally for one application */
+func (api *Api) getJobs(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		application := r.URL.Query().Get("application")
+		if application == "" {
+			returnJson(w, api.state.ListOfJobs())
+			return
+		}
+		returnJson(w, api.state.ListOfApplicationJobs(application))
+	}
+}
+
+func (api *Api) runJob(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		if r.Method != "POST" {
+			http.Error(w, "Jobs are started with a POST", 405)
+			return
+		}
+
+		applicationName := r.URL.Query().Get("application")
+		application, err := api.configurationStore.GetConfiguration(applicationName)
+		if err != nil || !application.IsJob() {
+			http.Error(w, "Could not find job application", 404)
+			return
+		}
+
+		if application.GetLatestPublishedConfiguration() == nil {
+			http.Error(w, "Job has no published version", 400)
+			return
+		}
+
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+			Message: fmt.Sprintf("API: Job run requested for application %s", applicationName),
+			AppId:   applicationName,
+		})
+		returnJson(w, api.state.StartJob(application, uuid.NewV4().String(), time.Now()))
+	}
+}
+
+/* Logs the app wrote on the runs host since the run started */
+func (api *Api) getJobRunLogs(w http.ResponseWriter, r *http.Request) {
+	if api.authenticate_user(w, r) {
+		job, err := api.state.GetJob(r.URL.Query().Get("job"))
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+
+		runId := r.URL.Query().Get("run")
+		for _, run := range job.Runs {
+			if run.Id == runId {
+				limit := r.URL.Query().Get("limit")
+				search := r.URL.Query().Get("search")
+				since := run.Started.UTC().Format("2006-01-02T15:04:05.999Z")
+				returnJson(w, state.Audit.Query__AppHostLog(job.Application, run.HostId, limit, search, since))
+				return
+			}
+		}
+		http.Error(w, "No such run", 404)
+	}
+}
+
 func (api *Api) getHostLatestPerformance(w http.ResponseWriter, r *http.Request) {
 	if api.authenticate_user(w, r) {
 		host := r.URL.Query().Get("host")
@@ -205,7 +205,7 @@ func (engine *AwsCloudEngine) TerminateInstance(hostId HostId) bool {
 func (aws *AwsCloudEngine) GetPem() string {
 	return aws.sshKeyPath
 }
-func (engine *AwsCloudEngine) RegisterWithLb(hostId string, lbId string) {
+func (engine *AwsCloudEngine) RegisterWithLb(hostId string, lbId string) bool {
 	svc := elb.New(session.New(&aws.Config{Region: aws.String(engine.awsRegion)}))
 
 	params := &elb.RegisterInstancesWithLoadBalancerInput{
@@ -217,12 +217,10 @@ func (engine *AwsCloudEngine) RegisterWithLb(hostId string, lbId string) {
 		LoadBalancerName: aws.String(string(lbId)),
 	}
 	_, err := svc.RegisterInstancesWithLoadBalancer(params)
-	if err != nil {
-		return
-	}
+	return err == nil
 }
 
-func (engine *AwsCloudEngine) DeRegisterWithLb(hostId string, lbId string) {
+func (engine *AwsCloudEngine) DeRegisterWithLb(hostId string, lbId string) bool {
 	svc := elb.New(session.New(&aws.Config{Region: aws.String(engine.awsRegion)}))
 
 	params := &elb.DeregisterInstancesFromLoadBalancerInput{
@@ -230,9 +228,7 @@ func (engine *AwsCloudEngine) DeRegisterWithLb(hostId string, lbId string) {
 		LoadBalancerName: aws.String(string(lbId)),
 	}
 	_, err := svc.DeregisterInstancesFromLoadBalancer(params)
-	if err != nil {
-		return
-	}
+	return err == nil
 }
 
 func (engine *AwsCloudEngine) SpawnSpotInstanceSync(change *model.ChangeServer) *model.Host {
@@ -23,6 +23,7 @@ import (
 	"orca/trainer/model"
 	"orca/trainer/state"
 	orcaSSh "orca/util"
+	"sync"
 	"time"
 )
 
@@ -36,6 +37,11 @@ type CloudProvider struct {
 	commands		[]string
 
 	lastSpotInstanceFailure time.Time
+
+	/* Hosts joined to each load balancer by SyncLoadBalancers, keyed by loadBalancerKey */
+	lbMutex    sync.Mutex
+	registered map[string]lbRegistration
+	lbSynced   map[string]bool
 }
 
 func (cloud *CloudProvider) Init(engine CloudEngine, sshUser string, apiEndpoint string, loggingEndpoint string, commands []string) {
@@ -54,6 +60,15 @@ func (cloud *CloudProvider) ActionChange(change *model.ChangeServer, stateStore
 		/* Here we can spawn a new server */
 		if change.Type == "new_server" {
 			var newHost *model.Host
+			if change.RequiresSpotInstance && !cloud.canLaunchSpotInstance() {
+				/* Spot only apps do not fall back to reliable instances, the change times out and the planner tries again */
+				state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+					Message: fmt.Sprintf("Could not launch spot only server for application %s, spot capacity is unavailable", change.ApplicationName),
+					AppId:   change.ApplicationName,
+				})
+				return
+			}
+
 			if !change.RequiresReliableInstance && cloud.canLaunchSpotInstance() {
 				change.SpotInstanceRequested = true
 				newHost = cloud.Engine.SpawnSpotInstanceSync(change)
@@ -69,6 +84,11 @@ func (cloud *CloudProvider) ActionChange(change *model.ChangeServer, stateStore
 				})
 
 				newHost.GroupingTag = change.GroupingTag /* TODO Persist this guy as a tag*/
+				newHost.Requested = change.Time
+				newHost.Labels = make(map[string]string)
+				for key, value := range change.Labels {
+					newHost.Labels[key] = value
+				}
 
 				stateStore.HostInit(newHost)
 
@@ -76,6 +96,7 @@ func (cloud *CloudProvider) ActionChange(change *model.ChangeServer, stateStore
 				change.NewHostId = string(newHost.Id)
 				change.InstanceLaunched = true
 				cloud.Engine.SetTag(newHost.Id, "GroupingTag", newHost.GroupingTag)
+				cloud.SetHostLabels(newHost.Id, newHost.Labels)
 
 				/* A new server was created, wahoo */
 				/* Next we should install some stuff to it */
@@ -137,11 +158,15 @@ func (cloud *CloudProvider) ActionChange(change *model.ChangeServer, stateStore
 			stateStore.RemoveHost(change.NewHostId)
 
 		} else if change.Type == "loadbalancer_join" {
-			cloud.Engine.RegisterWithLb(change.NewHostId, change.LoadBalancerName)
+			if !cloud.Engine.RegisterWithLb(change.NewHostId, change.LoadBalancerName) {
+				cloud.loadBalancerChangeFailed(change)
+			}
 			cloud.RemoveChange(change.Id, true)
 
 		} else if change.Type == "loadbalancer_leave" {
-			cloud.Engine.DeRegisterWithLb(change.NewHostId, change.LoadBalancerName)
+			if !cloud.Engine.DeRegisterWithLb(change.NewHostId, change.LoadBalancerName) {
+				cloud.loadBalancerChangeFailed(change)
+			}
 			cloud.RemoveChange(change.Id, true)
 
 		} else if change.Type == "app_tag_add" {
@@ -235,6 +260,52 @@ func (cloud *CloudProvider) canLaunchSpotInstance() bool {
 	return (time.Now().Unix() - cloud.lastSpotInstanceFailure.Unix()) > 60*60*2
 }
 
+/* Labels are stored as one cloud tag per key, an empty value means the label was removed */
+const LABEL_TAG_PREFIX = "Label_"
+
+func (cloud *CloudProvider) SetHostLabels(hostId string, labels map[string]string) {
+	for key, value := range labels {
+		cloud.Engine.SetTag(hostId, LABEL_TAG_PREFIX+key, value)
+	}
+}
+
+func (cloud *CloudProvider) GetHostLabels(hostId string, keys []string) map[string]string {
+	labels := make(map[string]string)
+	for _, key := range keys {
+		value := cloud.Engine.GetTag(LABEL_TAG_PREFIX+key, hostId)
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+/* Cordon and drain are kept as tags like labels, so a restarted trainer does not fill a host that is being emptied */
+const (
+	CORDONED_TAG = "Cordoned"
+	DRAINING_TAG = "Draining"
+)
+
+func maintenanceTag(set bool) string {
+	if set {
+		return "true"
+	}
+	return ""
+}
+
+func (cloud *CloudProvider) SetHostMaintenance(hostId string, cordoned bool, draining bool) {
+	cloud.Engine.SetTag(hostId, CORDONED_TAG, maintenanceTag(cordoned))
+	cloud.Engine.SetTag(hostId, DRAINING_TAG, maintenanceTag(draining))
+}
+
+func (cloud *CloudProvider) GetHostMaintenance(hostId string) (bool, bool) {
+	return cloud.Engine.GetTag(CORDONED_TAG, hostId) == "true", cloud.Engine.GetTag(DRAINING_TAG, hostId) == "true"
+}
+
+func (cloud *CloudProvider) CanLaunchSpotInstance() bool {
+	return cloud.canLaunchSpotInstance()
+}
+
 func (cloud *CloudProvider) BackupConfiguration(configuration string) bool {
 	return cloud.Engine.BackupConfiguration(configuration)
 }
@@ -2,6 +2,8 @@ package cloud
 
 import (
 	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
 	"testing"
 	"time"
 )
@@ -31,3 +33,94 @@ func TestPlan_canLaunchSpots_Fails(t *testing.T) {
 	}
 }
 
+
+func TestSyncLoadBalancers_FollowsReadiness(t *testing.T) {
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+
+	versionConfig := make(map[string]*model.VersionConfig)
+	versionConfig["1"] = &model.VersionConfig{
+		Version:      "1",
+		LoadBalancer: []model.LoadBalancerEntry{{Domain: "elb1"}},
+	}
+	config.Add("app1", &model.ApplicationConfiguration{Name: "app1", PublishedConfig: versionConfig, Enabled: true})
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+	stateStore.Add("host1", &model.Host{Id: "host1", State: "running", Apps: []model.Application{{Name: "app1", Version: "1", State: "installing"}}})
+	host := stateStore.GetAllHosts()["host1"]
+
+	cloud := CloudProvider{}
+	changeTypes := func() []string {
+		ret := make([]string, 0)
+		for _, change := range cloud.loadBalancerChanges(config, &stateStore) {
+			if change.NewHostId != "host1" || change.LoadBalancerName != "elb1" {
+				t.Errorf("%+v", change)
+			}
+			ret = append(ret, change.Type)
+		}
+		return ret
+	}
+
+	/* Nothing is known after a restart, so a host that is not ready is taken out in case it was registered */
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_leave" {
+		t.Errorf("%+v", changes)
+	}
+
+	/* Not registered while the container is still coming up */
+	if changes := changeTypes(); len(changes) != 0 {
+		t.Errorf("%+v", changes)
+	}
+
+	host.Apps[0].State = "running"
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_join" {
+		t.Errorf("%+v", changes)
+	}
+	if changes := changeTypes(); len(changes) != 0 {
+		t.Errorf("joined twice %+v", changes)
+	}
+
+	/* A join the cloud provider refused is tried again */
+	cloud.loadBalancerChangeFailed(&model.ChangeServer{Type: "loadbalancer_join", NewHostId: "host1", LoadBalancerName: "elb1", ApplicationName: "app1"})
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_join" {
+		t.Errorf("%+v", changes)
+	}
+
+	/* Failing checks take it out, recovering puts it back */
+	host.Apps[0].State = "checks_failed"
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_leave" {
+		t.Errorf("%+v", changes)
+	}
+
+	host.Apps[0].State = "running"
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_join" {
+		t.Errorf("%+v", changes)
+	}
+
+	/* The trainers own checks count too */
+	host.Probes = map[string]*model.AppProbe{"app1": {Version: "1", Failing: true}}
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_leave" {
+		t.Errorf("%+v", changes)
+	}
+	host.Probes = nil
+	changeTypes()
+
+	/* A planned removal deregisters before the container goes */
+	host.Changes = []model.ChangeApplication{{Type: "remove_application", Name: "app1"}}
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_leave" {
+		t.Errorf("%+v", changes)
+	}
+
+	/* As is a leave */
+	cloud.loadBalancerChangeFailed(&model.ChangeServer{Type: "loadbalancer_leave", NewHostId: "host1", LoadBalancerName: "elb1", ApplicationName: "app1"})
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_leave" {
+		t.Errorf("%+v", changes)
+	}
+
+	/* A ready host is joined again after a restart, we cannot know it still is */
+	host.Changes = nil
+	cloud = CloudProvider{}
+	if changes := changeTypes(); len(changes) != 1 || changes[0] != "loadbalancer_join" {
+		t.Errorf("%+v", changes)
+	}
+}
@@ -32,8 +32,8 @@ type CloudEngine interface {
 	WasSpotInstanceTerminatedDueToPrice(spotRequestId string) (bool, string)
 	GetIp(hostId string) string
 	GetPem() string
-	RegisterWithLb(hostId string, elb string)
-	DeRegisterWithLb(hostId string, elb string)
+	RegisterWithLb(hostId string, elb string) bool
+	DeRegisterWithLb(hostId string, elb string) bool
 	SanityCheckHosts(map[string]*model.Host)
 	AddNameTag(newHostId string, appName string)
 	RemoveNameTag(newHostId string, appName string)
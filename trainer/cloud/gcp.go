@@ -355,7 +355,7 @@ func (engine *GcpCloudEngine) MonitorDataQueue(name string) int {
 	return 0
 }
 
-func (engine *GcpCloudEngine) RegisterWithLb(hostId string, lbId string) {
+func (engine *GcpCloudEngine) RegisterWithLb(hostId string, lbId string) bool {
 	endpoints := make([]*compute.NetworkEndpoint, 1)
 	endpoint := compute.NetworkEndpoint{
 		Instance: hostId,
@@ -372,12 +372,12 @@ func (engine *GcpCloudEngine) RegisterWithLb(hostId string, lbId string) {
 
 	if err != nil {
 		log.Printf("Register with LB failed, %s", err)
+		return false
 	}
-
-	return
+	return true
 }
 
-func (engine *GcpCloudEngine) DeRegisterWithLb(hostId string, lbId string) {
+func (engine *GcpCloudEngine) DeRegisterWithLb(hostId string, lbId string) bool {
 	endpoints := make([]*compute.NetworkEndpoint, 1)
 	endpoint := compute.NetworkEndpoint{
 		Instance: hostId,
@@ -394,5 +394,7 @@ func (engine *GcpCloudEngine) DeRegisterWithLb(hostId string, lbId string) {
 
 	if err != nil {
 		log.Printf("DeRegister with LB failed, %s", err)
+		return false
 	}
+	return true
 }
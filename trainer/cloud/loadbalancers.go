@@ -0,0 +1,211 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"fmt"
+	"github.com/twinj/uuid"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"sort"
+	"time"
+)
+
+type lbRegistration struct {
+	LoadBalancer    string
+	HostId          string
+	ApplicationName string
+
+	/* Assumed rather than joined by us, so it is deregistered in case an earlier trainer left it there */
+	Unknown bool
+}
+
+func loadBalancerKey(loadBalancer string, hostId string) string {
+	return loadBalancer + "|" + hostId
+}
+
+/*
+	A host belongs in an apps load balancers once the app reports running on it and passes the trainers checks,
+	and not while a remove_application for the app is pending on it. Job runs never serve traffic.
+*/
+func wantedRegistrations(configurationStore configuration.ConfigurationStore, stateStore *state.StateStore) map[string]lbRegistration {
+	ret := make(map[string]lbRegistration)
+	for _, host := range stateStore.GetAllRunningHosts() {
+		for _, app := range host.Apps {
+			appConfiguration, err := configurationStore.GetConfiguration(app.Name)
+			if err != nil || appConfiguration.IsJob() || !host.HasAppWithSameVersionRunning(app.Name, app.Version) || removePending(host, app.Name) {
+				continue
+			}
+
+			config := appConfiguration.PublishedConfig[app.Version]
+			if config == nil {
+				continue
+			}
+
+			for _, elb := range config.LoadBalancer {
+				ret[loadBalancerKey(elb.Domain, host.Id)] = lbRegistration{LoadBalancer: elb.Domain, HostId: host.Id, ApplicationName: app.Name}
+			}
+		}
+	}
+	return ret
+}
+
+func removePending(host *model.Host, application string) bool {
+	for _, change := range host.Changes {
+		if change.Type == "remove_application" && change.Name == application {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Registrations are not kept across restarts, so the first time a host is synced it is assumed to be in
+	every load balancer of every configured app, and taken out of the ones it does not belong in.
+*/
+func (cloud *CloudProvider) assumeRegistrations(configurationStore configuration.ConfigurationStore, stateStore *state.StateStore) {
+	hosts := stateStore.GetAllHosts()
+	for hostId := range cloud.lbSynced {
+		if _, ok := hosts[hostId]; !ok {
+			delete(cloud.lbSynced, hostId)
+		}
+	}
+
+	for hostId := range hosts {
+		if cloud.lbSynced[hostId] {
+			continue
+		}
+		cloud.lbSynced[hostId] = true
+
+		for _, appConfiguration := range configurationStore.GetAllConfiguration() {
+			if appConfiguration.IsJob() {
+				continue
+			}
+
+			for _, config := range appConfiguration.PublishedConfig {
+				for _, elb := range config.LoadBalancer {
+					key := loadBalancerKey(elb.Domain, hostId)
+					if _, ok := cloud.registered[key]; !ok {
+						cloud.registered[key] = lbRegistration{LoadBalancer: elb.Domain, HostId: hostId, ApplicationName: appConfiguration.Name, Unknown: true}
+					}
+				}
+			}
+		}
+	}
+}
+
+/* The joins and leaves that bring the load balancers in line with what is ready, in a stable order */
+func (cloud *CloudProvider) loadBalancerChanges(configurationStore configuration.ConfigurationStore, stateStore *state.StateStore) []*model.ChangeServer {
+	cloud.lbMutex.Lock()
+	defer cloud.lbMutex.Unlock()
+
+	if cloud.registered == nil {
+		cloud.registered = make(map[string]lbRegistration)
+		cloud.lbSynced = make(map[string]bool)
+	}
+
+	wanted := wantedRegistrations(configurationStore, stateStore)
+	cloud.assumeRegistrations(configurationStore, stateStore)
+	keys := make([]string, 0)
+	for key := range wanted {
+		keys = append(keys, key)
+	}
+	for key := range cloud.registered {
+		if _, ok := wanted[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	ret := make([]*model.ChangeServer, 0)
+	for _, key := range keys {
+		registration, want := wanted[key]
+		registered, have := cloud.registered[key]
+		if want && registered.Unknown {
+			/* Ready, but we do not know it is registered so join it again */
+			have = false
+		}
+		if want == have {
+			continue
+		}
+
+		severity := state.AUDIT__INFO
+		changeType := "loadbalancer_join"
+		message := "Registering host %s with load balancer %s for application %s, it is running and passing its checks"
+		if have {
+			registration = registered
+			changeType = "loadbalancer_leave"
+			message = "Deregistering host %s with load balancer %s for application %s, it is no longer running and passing its checks"
+			if registration.Unknown {
+				severity = state.AUDIT__DEBUG
+				message = "Deregistering host %s with load balancer %s for application %s, it is not ready and may have been registered before a restart"
+			}
+			delete(cloud.registered, key)
+		} else {
+			cloud.registered[key] = registration
+		}
+
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: severity,
+			Message: fmt.Sprintf(message, registration.HostId, registration.LoadBalancer, registration.ApplicationName),
+			AppId:   registration.ApplicationName,
+			HostId:  registration.HostId,
+		})
+
+		ret = append(ret, &model.ChangeServer{
+			Id:               uuid.NewV4().String(),
+			Type:             changeType,
+			Time:             time.Now().Format(time.RFC3339Nano),
+			LoadBalancerName: registration.LoadBalancer,
+			NewHostId:        registration.HostId,
+			ApplicationName:  registration.ApplicationName,
+		})
+	}
+	return ret
+}
+
+/* Undoes the bookkeeping of a join or leave the cloud provider refused, so the next sync tries it again */
+func (cloud *CloudProvider) loadBalancerChangeFailed(change *model.ChangeServer) {
+	cloud.lbMutex.Lock()
+	defer cloud.lbMutex.Unlock()
+
+	key := loadBalancerKey(change.LoadBalancerName, change.NewHostId)
+	if change.Type == "loadbalancer_join" {
+		delete(cloud.registered, key)
+	} else {
+		cloud.registered[key] = lbRegistration{LoadBalancer: change.LoadBalancerName, HostId: change.NewHostId, ApplicationName: change.ApplicationName}
+	}
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+		Message: fmt.Sprintf("Could not update load balancer %s for host %s, will retry, %s", change.LoadBalancerName, change.NewHostId, change.Type),
+		AppId:   change.ApplicationName,
+		HostId:  change.NewHostId,
+	})
+}
+
+/*
+	Registration follows readiness rather than the add_application change, so a host only joins once its app is serving,
+	leaves when the app fails or is being removed, and joins again when it recovers.
+	Nothing is known about the load balancers at startup, so every ready host is joined again and every other one taken out.
+*/
+func (cloud *CloudProvider) SyncLoadBalancers(configurationStore configuration.ConfigurationStore, stateStore *state.StateStore) {
+	for _, change := range cloud.loadBalancerChanges(configurationStore, stateStore) {
+		cloud.ActionChange(change, stateStore)
+	}
+}
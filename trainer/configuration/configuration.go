@@ -27,7 +27,8 @@ import (
 	"orca/trainer/model"
 	"orca/util"
 	"os"
-	"reflect"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -61,6 +62,8 @@ func (store *ConfigurationStore) Init(trainerConfigurationFilePath string) {
 		AuditDatabaseUri:       "http://localhost:9200",
 		StatsDatabaseUri:       "localhost",
 		ServerTTL:              86400,
+		ProbeTimeout:           5,
+		ProbeFailureThreshold:  3,
 		CloudProviderCommands:  make([]string, 0),
 	}
 }
@@ -84,6 +87,14 @@ func (store *ConfigurationStore) Save() {
 	store.saveConfigToFile(store.trainerConfigurationFilePath)
 }
 
+/* A file the trainer keeps next to its configuration, empty when the configuration is not backed by a file */
+func (store *ConfigurationStore) SiblingPath(name string) string {
+	if store.trainerConfigurationFilePath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(store.trainerConfigurationFilePath), name)
+}
+
 func (store *ConfigurationStore) loadApplicationConfigurationsFromFile(filename string) {
 	Logger.InitLogger.Infof("Loading config file from %s", filename)
 	file, err := os.Open(filename)
@@ -106,6 +117,12 @@ func (store *ConfigurationStore) loadApplicationConfigurationsFromFile(filename
 		fmt.Sprintf("error: %v", err)
 	}
 
+	for name, app := range store.ApplicationConfigurations {
+		if err := app.CompileSchedule(); err != nil {
+			Logger.InitLogger.Errorf("Schedule parts for %s do not compile, keeping the saved grid: %s", name, err)
+		}
+	}
+
 	Logger.InitLogger.Infof("Load done")
 	file.Close()
 }
@@ -149,43 +166,133 @@ func AppExistsInList(items []*model.ApplicationConfiguration, appName string) bo
 	return false
 }
 
-func (store *ConfigurationStore) GetAllConfigurations_MoveLeft(items []*model.ApplicationConfiguration) []*model.ApplicationConfiguration {
+func sortedDependencyNames(app *model.ApplicationConfiguration) []string {
+	names := make([]string, 0)
+	for _, dependency := range app.Depends {
+		names = append(names, dependency.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* Dependencies come before the apps that need them, ties are broken by name. A cycle is broken wherever we first meet it rather than looping forever */
+func (store *ConfigurationStore) GetAllConfigurationAsOrderedList() []*model.ApplicationConfiguration {
+	names := make([]string, 0)
+	for name := range store.ApplicationConfigurations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	ret := make([]*model.ApplicationConfiguration, 0)
-	for _, app := range items {
-		/* Check dependencies */
-		for _, dependency := range app.Depends {
-			if !AppExistsInList(ret, dependency.Name) {
-				dependency_app, err := store.GetConfiguration(dependency.Name)
-				if err == nil {
-					ret = append(ret, dependency_app)
-				}
-			}
+	visited := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
 		}
+		visited[name] = true
 
-		if !AppExistsInList(ret, app.Name) {
-			ret = append(ret, app)
+		app, ok := store.ApplicationConfigurations[name]
+		if !ok {
+			return
 		}
-	}
 
-	if !reflect.DeepEqual(items, ret) {
-		return store.GetAllConfigurations_MoveLeft(ret)
+		for _, dependency := range sortedDependencyNames(app) {
+			visit(dependency)
+		}
+		ret = append(ret, app)
 	}
 
+	for _, name := range names {
+		visit(name)
+	}
 	return ret
 }
 
-func (store *ConfigurationStore) GetAllConfigurationAsOrderedList() []*model.ApplicationConfiguration {
-	ret := make([]*model.ApplicationConfiguration, 0)
-	for _, applicationConfiguration := range store.GetAllConfiguration() {
-		ret = append(ret, applicationConfiguration)
+/* Returns the path of the cycle that saving these dependencies for appName would create, or nil if there is none */
+func (store *ConfigurationStore) FindDependencyCycle(appName string, depends []model.Dependency) []string {
+	dependenciesOf := func(name string) []string {
+		if name == appName {
+			return sortedDependencyNames(&model.ApplicationConfiguration{Depends: depends})
+		}
+
+		app, ok := store.ApplicationConfigurations[name]
+		if !ok {
+			return []string{}
+		}
+		return sortedDependencyNames(app)
+	}
+
+	path := make([]string, 0)
+	onPath := make(map[string]bool)
+	done := make(map[string]bool)
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		if onPath[name] {
+			for i, entry := range path {
+				if entry == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+
+		if done[name] {
+			return nil
+		}
+
+		path = append(path, name)
+		onPath[name] = true
+		for _, dependency := range dependenciesOf(name) {
+			if cycle := visit(dependency); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		onPath[name] = false
+		done[name] = true
+		return nil
 	}
 
-	return store.GetAllConfigurations_MoveLeft(ret)
+	return visit(appName)
+}
+
+func (store *ConfigurationStore) ValidateDependencies(appName string, depends []model.Dependency) error {
+	cycle := store.FindDependencyCycle(appName, depends)
+	if cycle != nil {
+		return errors.New(fmt.Sprintf("Dependencies of %s form a cycle: %s", appName, strings.Join(cycle, " -> ")))
+	}
+	return nil
 }
+
 func (store *ConfigurationStore) GetAllConfiguration() map[string]*model.ApplicationConfiguration {
 	return store.ApplicationConfigurations
 }
 
+/* Cloud engines can only fetch tags by name, so these are the labels we look for when discovering a host */
+func (store *ConfigurationStore) GetPlacementLabelKeys() []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, application := range store.ApplicationConfigurations {
+		for _, config := range application.PublishedConfig {
+			selectors := append([]model.LabelSelector{}, config.Placement.Required...)
+			for _, preferred := range config.Placement.Preferred {
+				selectors = append(selectors, preferred.Selector)
+			}
+
+			for _, selector := range selectors {
+				if !seen[selector.Key] {
+					seen[selector.Key] = true
+					keys = append(keys, selector.Key)
+				}
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (store *ConfigurationStore) GetConfigAsString() string {
 	res, err := json.MarshalIndent(store, "", "  ")
 	if err != nil {
@@ -194,21 +301,43 @@ func (store *ConfigurationStore) GetConfigAsString() string {
 	return string(res)
 }
 
+/*
+	What the schedule asks for right now, never less than MinDeployment and never more than MaxDeployment.
+	Increases due within the apps lead time are brought forward so capacity is running when they start,
+	decreases still wait until they are due.
+*/
+func (store *ConfigurationStore) ScheduledDesired(config *model.ApplicationConfiguration, now time.Time) int {
+	scheduled := config.DeploymentSchedule.MaxBetween(now, now.Add(config.LeadTime()))
+	if config.DisableSchedule || scheduled <= config.MinDeployment {
+		return config.TargetMinDeployment()
+	}
+
+	return config.CapDeployment(scheduled)
+}
+
+/* Min schedules are not brought forward by the lead time, desired is what pre-scales */
 func (store *ConfigurationStore) ApplySchedules() {
+	now := time.Now()
 	for _, config := range store.ApplicationConfigurations {
 		if config.DisableSchedule {
 			continue
 		}
 
-		if config.DeploymentSchedule.Get(time.Now()) == 0 {
+		if !config.MinSchedule.IsEmpty() {
+			config.MinDeployment = config.CapDeployment(config.MinSchedule.Get(now))
+		}
+
+		/* The autoscaler owns DesiredDeployment for these and uses the schedule as its floor */
+		if config.IsAutoscaled() {
 			continue
 		}
 
-		if config.DeploymentSchedule.Get(time.Now()) > config.MinDeployment {
-			config.DesiredDeployment = config.DeploymentSchedule.Get(time.Now())
-		} else {
-			config.DesiredDeployment = config.MinDeployment
+		/* An empty schedule sets nothing, a set schedule is followed down to zero */
+		if config.DeploymentSchedule.IsEmpty() {
+			continue
 		}
+
+		config.DesiredDeployment = store.ScheduledDesired(config, now)
 	}
 }
 
@@ -227,6 +356,7 @@ func (store *ConfigurationStore) RequestPublishConfiguration(config *model.Appli
 		EnvironmentVariables: templateForConfiguration.EnvironmentVariables,
 		Checks:               templateForConfiguration.Checks,
 		GroupingTag:          templateForConfiguration.GroupingTag,
+		Placement:            templateForConfiguration.Placement.Copy(),
 		InstanceType:         templateForConfiguration.InstanceType,
 
 		AppliedPropertyGroups: make(map[string]int),
@@ -257,6 +387,57 @@ func (store *ConfigurationStore) RequestPublishConfiguration(config *model.Appli
 	store.Save()
 }
 
+/* Re-publishes a previously good version as a brand new version so the planner rolls forward onto it */
+func (store *ConfigurationStore) RequestRollbackConfiguration(config *model.ApplicationConfiguration, target *model.VersionConfig) *model.VersionConfig {
+	badConfiguration := config.GetLatestPublishedConfiguration()
+
+	rollbackConfiguration := (*target)
+	rollbackConfiguration.Version = config.GetSuitableNextVersion()
+	rollbackConfiguration.DeploymentFailures = 0
+	rollbackConfiguration.DeploymentSuccess = 0
+	rollbackConfiguration.KnownBad = false
+	rollbackConfiguration.KnownGood = false
+	rollbackConfiguration.RollbackOf = badConfiguration.Version
+	rollbackConfiguration.RollbackHandled = false
+
+	rollbackConfiguration.Files = make([]model.File, len(target.Files))
+	copy(rollbackConfiguration.Files, target.Files)
+
+	rollbackConfiguration.SecurityGroups = make([]model.SecurityGroup, len(target.SecurityGroups))
+	copy(rollbackConfiguration.SecurityGroups, target.SecurityGroups)
+
+	rollbackConfiguration.EnvironmentVariables = make([]model.EnvironmentVariable, len(target.EnvironmentVariables))
+	copy(rollbackConfiguration.EnvironmentVariables, target.EnvironmentVariables)
+
+	rollbackConfiguration.LoadBalancer = make([]model.LoadBalancerEntry, len(target.LoadBalancer))
+	copy(rollbackConfiguration.LoadBalancer, target.LoadBalancer)
+
+	rollbackConfiguration.PortMappings = make([]model.PortMapping, len(target.PortMappings))
+	copy(rollbackConfiguration.PortMappings, target.PortMappings)
+
+	rollbackConfiguration.VolumeMappings = make([]model.VolumeMapping, len(target.VolumeMappings))
+	copy(rollbackConfiguration.VolumeMappings, target.VolumeMappings)
+
+	rollbackConfiguration.DataQueue = make([]model.DataQueue, len(target.DataQueue))
+	copy(rollbackConfiguration.DataQueue, target.DataQueue)
+
+	rollbackConfiguration.Checks = make([]model.ApplicationChecks, len(target.Checks))
+	copy(rollbackConfiguration.Checks, target.Checks)
+
+	rollbackConfiguration.Placement = target.Placement.Copy()
+
+	rollbackConfiguration.AppliedPropertyGroups = make(map[string]int)
+	for name, version := range target.AppliedPropertyGroups {
+		rollbackConfiguration.AppliedPropertyGroups[name] = version
+	}
+
+	badConfiguration.RollbackHandled = true
+	config.PublishedConfig[rollbackConfiguration.Version] = &rollbackConfiguration
+	store.Save()
+
+	return &rollbackConfiguration
+}
+
 func (store *ConfigurationStore) DoesRequestPublishConfigurationMakeSense(config *model.ApplicationConfiguration) bool {
 	templateForConfiguration := config.GetLatestConfiguration()
 	lastPublishedConfiguration := config.GetLatestPublishedConfiguration()
@@ -273,11 +454,16 @@ func (store *ConfigurationStore) DoesRequestPublishConfigurationMakeSense(config
 		EnvironmentVariables: templateForConfiguration.EnvironmentVariables,
 		Checks:               templateForConfiguration.Checks,
 		GroupingTag:          templateForConfiguration.GroupingTag,
+		Placement:            templateForConfiguration.Placement.Copy(),
 
 		AppliedPropertyGroups: lastPublishedConfiguration.AppliedPropertyGroups,
 		DeploymentFailures:    lastPublishedConfiguration.DeploymentFailures,
 		DeploymentSuccess:     lastPublishedConfiguration.DeploymentSuccess,
 		InstanceType:          templateForConfiguration.InstanceType,
+		KnownBad:              lastPublishedConfiguration.KnownBad,
+		KnownGood:             lastPublishedConfiguration.KnownGood,
+		RollbackOf:            lastPublishedConfiguration.RollbackOf,
+		RollbackHandled:       lastPublishedConfiguration.RollbackHandled,
 	}
 
 	publishedConfiguration.Files = make([]model.File, len(templateForConfiguration.Files))
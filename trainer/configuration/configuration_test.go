@@ -0,0 +1,74 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package configuration
+
+import (
+	"io/ioutil"
+	"orca/trainer/model"
+	"os"
+	"testing"
+)
+
+func TestRequestRollbackConfiguration_LastGoodVersion(t *testing.T) {
+	configFile, _ := ioutil.TempFile("", "orca_rollback_test")
+	defer os.Remove(configFile.Name())
+
+	config := ConfigurationStore{}
+	config.Init(configFile.Name())
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:           "1",
+		Network:           "network1",
+		DeploymentSuccess: 3,
+		PortMappings:      []model.PortMapping{{HostPort: "8080", ContainerPort: "80"}},
+		Checks:            []model.ApplicationChecks{{Type: model.CHECK__TCP, Goal: "80"}},
+	}
+	versionConfigApp1["2"] = &model.VersionConfig{Version: "2", Network: "network2", DeploymentSuccess: 1, KnownBad: true}
+	versionConfigApp1["3"] = &model.VersionConfig{Version: "3", Network: "network3", DeploymentFailures: 2}
+
+	app := config.Add("app1", &model.ApplicationConfiguration{
+		Name:            "app1",
+		MinDeployment:   1,
+		PublishedConfig: versionConfigApp1,
+		Enabled:         true,
+		AutoRollback:    true,
+	})
+
+	lastGood := app.GetLastGoodPublishedConfiguration()
+	if lastGood == nil || lastGood.Version != "1" {
+		t.Fatalf("expected version 1 to be the last good version, got %+v", lastGood)
+	}
+
+	rollback := config.RequestRollbackConfiguration(app, lastGood)
+	if rollback.Version != "4" || rollback.RollbackOf != "3" || rollback.Network != "network1" || rollback.DeploymentSuccess != 0 {
+		t.Errorf("%+v", rollback)
+	}
+
+	if app.GetLatestPublishedVersion() != "4" || !versionConfigApp1["3"].RollbackHandled {
+		t.Errorf("%+v", app.PublishedConfig)
+	}
+
+	/* The rollback is a copy, editing it leaves the good version alone */
+	rollback.PortMappings[0].HostPort = "9090"
+	rollback.Checks[0].Goal = "90"
+	if lastGood.PortMappings[0].HostPort != "8080" || lastGood.Checks[0].Goal != "80" {
+		t.Errorf("%+v", lastGood)
+	}
+}
@@ -38,6 +38,21 @@ type LoggingWebHook struct {
 	Password    string
 }
 
+/* Cpu and Memory are in the same units as an apps CpuNeeds and MemoryNeeds, Price is per hour */
+type InstanceCatalogEntry struct {
+	Name         string
+	Cpu          float64
+	Memory       float64
+	Price        float64
+	SpotEligible bool
+	Provider     string /* Empty matches every provider */
+}
+
+const (
+	CONSOLIDATE__HOSTS = "hosts"
+	CONSOLIDATE__COST  = "cost"
+)
+
 type GlobalSettings struct {
 	ApiPort       int
 	LoggingPort   int
@@ -81,6 +96,26 @@ type GlobalSettings struct {
 	HostChangeFailureLimit int64
 	ServerTTL              int64
 	ServerCapacity         int64
+	MaxHostCount           int64 /* Zero means no limit */
+	MaxInstancesPerHost    int64 /* Instances of the same app on one host when the app sets no spread limit, zero means no limit */
+
+	/* Hourly price per instance type and what consolidation should minimise, either CONSOLIDATE__HOSTS or CONSOLIDATE__COST */
+	InstancePrices         map[string]float64
+	ConsolidationObjective string
+
+	/* Instance types new servers are picked from when an app does not name its own */
+	InstanceCatalog []InstanceCatalogEntry
+
+	/* The trainer runs every apps checks itself each ProbeInterval seconds, zero turns this off */
+	ProbeInterval         int64
+	ProbeTimeout          int64
+	ProbeFailureThreshold int
+
+	/*
+		Failed probes count as deployment failures of the version, and so towards auto rollback.
+		Set this where a partition between the trainer and the hosts is likely, it would otherwise roll back healthy releases.
+	*/
+	ProbeFailuresIgnoredByRollback bool
 
 	Users     map[string]User
 	HostToken string
@@ -95,3 +130,32 @@ type GlobalSettings struct {
 	EnvName          string
 	PlanningDisabled bool
 }
+
+func (settings *GlobalSettings) CatalogEntry(name string) (InstanceCatalogEntry, bool) {
+	for _, entry := range settings.InstanceCatalog {
+		if entry.Name == name && (entry.Provider == "" || entry.Provider == settings.CloudProvider) {
+			return entry, true
+		}
+	}
+	return InstanceCatalogEntry{}, false
+}
+
+/* A copy safe to hand out in bug reports, everything that grants access somewhere is blanked */
+func (settings GlobalSettings) Redacted() GlobalSettings {
+	settings.AWSAccessKeyId = ""
+	settings.AWSAccessKeySecret = ""
+	settings.AWSSSHKey = ""
+	settings.AWSSSHKeyPath = ""
+	settings.GcpCredentialsFile = ""
+	settings.GcpPemFile = ""
+	settings.GcpPublicKey = ""
+	settings.Users = nil
+	settings.HostToken = ""
+	settings.ApiTokens = nil
+	settings.AuditWebhooks = nil
+	settings.LoggingWebHooks = nil
+	settings.AuditDatabaseUri = ""
+	settings.StatsDatabaseUri = ""
+	settings.CloudProviderCommands = nil
+	return settings
+}
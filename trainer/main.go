@@ -26,11 +26,29 @@ import (
 	"orca/trainer/model"
 	"orca/trainer/monitor"
 	"orca/trainer/planner"
+	"orca/trainer/scaling"
 	"orca/trainer/state"
 	"strings"
 	"time"
 )
 
+func queuePublish(queued map[string]string, app *model.ApplicationConfiguration, version string) {
+	if queued[app.Name] == version {
+		return
+	}
+	queued[app.Name] = version
+
+	next := "none within the next month"
+	if at, ok := app.Maintenance.NextOpen(time.Now()); ok {
+		next = at.Format(time.RFC3339)
+	}
+
+	state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+		Message: fmt.Sprintf("MAINTENANCE: Configuration %s for app %s is queued until the next maintenance window, %s", version, app.Name, next),
+		AppId:   app.Name,
+	})
+}
+
 func main() {
 	fmt.Println("starting")
 
@@ -52,10 +70,20 @@ func main() {
 	state.Stats.Init(store)
 	monitor.Monit.Init()
 
+	if err := state_store.LoadJobs(); err != nil {
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+			Message: fmt.Sprintf("JOB: Could not load the job history, starting without it: %s", err),
+		})
+	}
+
 	/* Setup the planning engine */
 	plannerEngine := planner.BoringPlanner{}
 	plannerEngine.Init(store.GlobalSettings)
 
+	/* Setup the autoscaler */
+	autoscaler := scaling.Scaler{}
+	autoscaler.Init()
+
 	/* Setup the cloud provider */
 	cloud_provider := cloud.CloudProvider{}
 	if store.GlobalSettings.CloudProvider == "aws" {
@@ -78,6 +106,13 @@ func main() {
 		cloud_provider.Init(&gcpEngine, store.GlobalSettings.InstanceUsername, store.GlobalSettings.Uri, store.GlobalSettings.LoggingUri, store.GlobalSettings.CloudProviderCommands)
 	}
 
+	/* Versions waiting on a maintenance window, so we only audit them once */
+	queuedPublishes := make(map[string]string)
+
+	/* Probes are collected and applied in the planner loop, only the checks themselves run on their own ticker */
+	prober := monitor.Prober{}
+	prober.Init(store.GlobalSettings)
+
 	startTime := time.Now()
 	plannerAndTimeoutsTicker := time.NewTicker(time.Second * 20)
 	go func() {
@@ -87,6 +122,11 @@ func main() {
 				continue
 			}
 
+			if store.GlobalSettings.ProbeInterval > 0 {
+				prober.Apply(state_store, *store)
+				prober.Collect(state_store, *store)
+			}
+
 			if store.GlobalSettings.PlanningDisabled {
 				continue
 			}
@@ -102,19 +142,74 @@ func main() {
 				if latestConfiguredVersion == nil {
 					continue
 				}
+				/* Outside its maintenance windows a new version waits, rollbacks below still go out */
+				publishAllowed := app.Maintenance.IsOpen(time.Now())
+				if publishAllowed {
+					delete(queuedPublishes, app.Name)
+				}
+
 				if latestPublishedVersion == nil || latestConfiguredVersion.GetVersion() > latestPublishedVersion.GetVersion() {
-					/* Publish */
-					state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-						Message: fmt.Sprintf("Publishing application configuration %s for app %s", latestConfiguredVersion.Version, app.Name),
-						AppId:   app.Name,
-					})
+					if publishAllowed {
+						/* Publish */
+						state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+							Message: fmt.Sprintf("Publishing application configuration %s for app %s", latestConfiguredVersion.Version, app.Name),
+							AppId:   app.Name,
+						})
+
+						store.RequestPublishConfiguration(app)
 
-					store.RequestPublishConfiguration(app)
+						// Create DataQueues
+						for _, queue := range app.GetLatestConfiguration().DataQueue {
+							cloud_provider.CreateQueue(queue.Name, queue.RogueName)
+						}
 
-					// Create DataQueues
-					for _, queue := range app.GetLatestConfiguration().DataQueue {
-						cloud_provider.CreateQueue(queue.Name, queue.RogueName)
+						/* Every published version of a job is run once, cron jobs wait for their schedule */
+						if app.IsJob() && !app.IsCronJob() {
+							state_store.StartJob(app, uuid.NewV4().String(), time.Now())
+						}
+						continue
+					}
+
+					queuePublish(queuedPublishes, app, latestConfiguredVersion.Version)
+					if latestPublishedVersion == nil {
+						continue
+					}
+				}
+
+				/* The newest version is failing, roll back to the last version that deployed successfully */
+				if app.AutoRollback && latestPublishedVersion.IsBad() && !latestPublishedVersion.RollbackHandled {
+					lastGoodVersion := app.GetLastGoodPublishedConfiguration()
+					if lastGoodVersion == nil || latestPublishedVersion.RollbackOf != "" {
+						message := fmt.Sprintf("ROLLBACK FAILED: version %s of app %s is failing and there is no good version to roll back to, manual intervention required", latestPublishedVersion.Version, app.Name)
+						if latestPublishedVersion.RollbackOf != "" {
+							message = fmt.Sprintf("ROLLBACK FAILED: version %s of app %s, the rollback of failing version %s, is failing too, manual intervention required",
+								latestPublishedVersion.Version, app.Name, latestPublishedVersion.RollbackOf)
+						}
+						state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+							Message: message,
+							AppId:   app.Name,
+						})
+
+						latestPublishedVersion.RollbackHandled = true
+						store.Save()
+						continue
 					}
+
+					rollbackVersion := store.RequestRollbackConfiguration(app, lastGoodVersion)
+					state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+						Message: fmt.Sprintf("ROLLBACK: version %s of app %s failed %d times without a success, rolled back to version %s as new version %s",
+							latestPublishedVersion.Version, app.Name, latestPublishedVersion.DeploymentFailures, lastGoodVersion.Version, rollbackVersion.Version),
+						AppId: app.Name,
+					})
+					continue
+				}
+
+				/* Rolled back versions stay in place until a new configuration is pushed */
+				if latestPublishedVersion.RollbackOf != "" {
+					continue
+				}
+
+				if !publishAllowed {
 					continue
 				}
 
@@ -227,13 +322,15 @@ func main() {
 			/* How can we do this in a scalable way?? */
 
 			store.ApplySchedules()
+			autoscaler.Run(store)
 			cloud_provider.Engine.SanityCheckHosts(state_store.GetAllHosts())
 
-			/* Can we actually run the planner ? */
-			if state_store.HasChanges() || cloud_provider.HasChanges() {
-				continue
+			/* Pending changes only block the apps and hosts they touch */
+			plannerEngine.SetServerChanges(cloud_provider.GetAllChanges(), !cloud_provider.CanLaunchSpotInstance())
+			if state_store.ScheduleCronJobs(time.Now()) {
+				store.Save()
 			}
-
+			state_store.UpdateJobs(time.Now())
 			changes := plannerEngine.Plan((*store), (*state_store))
 			for _, change := range changes {
 				if change.Type == "new_server" {
@@ -241,16 +338,26 @@ func main() {
 						Message: fmt.Sprintf("Planner requested a new server, spot: %t subnet: %s", !change.RequiresReliableInstance, change.Network),
 					})
 
+					if change.Reason != "" {
+						state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+							Message: change.Reason,
+							AppId:   change.ApplicationName,
+						})
+					}
+
 					/* Add new server */
 					cloud_provider.ActionChange(&model.ChangeServer{
 						Id:                       uuid.NewV4().String(),
 						Type:                     "new_server",
 						Time:                     time.Now().Format(time.RFC3339Nano),
 						RequiresReliableInstance: change.RequiresReliableInstance,
+						RequiresSpotInstance:     change.RequiresSpotInstance,
 						Network:                  change.Network,
 						SecurityGroups:           change.SecurityGroups,
 						GroupingTag:              change.GroupingTag,
 						InstanceType:             change.InstanceType,
+						Labels:                   change.Labels,
+						ApplicationName:          change.ApplicationName,
 					}, state_store)
 
 					continue
@@ -266,29 +373,20 @@ func main() {
 
 					host, _ := state_store.GetConfiguration(change.HostId)
 					app, _ := store.GetConfiguration(change.ApplicationName)
+					changeId := uuid.NewV4().String()
 					host.Changes = append(host.Changes, model.ChangeApplication{
-						Id:        uuid.NewV4().String(),
-						Type:      "add_application",
-						HostId:    host.Id,
-						AppConfig: (*app.GetLatestPublishedConfiguration()),
-						Name:      change.ApplicationName,
-						Time:      time.Now().Format(time.RFC3339Nano),
+						Id:              changeId,
+						Type:            "add_application",
+						HostId:          host.Id,
+						AppConfig:       (*app.GetLatestPublishedConfiguration()),
+						Name:            change.ApplicationName,
+						Time:            time.Now().Format(time.RFC3339Nano),
+						RunToCompletion: change.JobId != "",
 					})
 
-					for _, elb := range app.GetLatestConfiguration().LoadBalancer {
-						state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-							Message: fmt.Sprintf("Registering host %s with load balancer %s for application %s", change.HostId, elb.Domain, change.ApplicationName),
-							AppId:   change.ApplicationName,
-							HostId:  change.HostId,
-						})
-
-						cloud_provider.ActionChange(&model.ChangeServer{
-							Id:               uuid.NewV4().String(),
-							Type:             "loadbalancer_join",
-							Time:             time.Now().Format(time.RFC3339Nano),
-							LoadBalancerName: elb.Domain,
-							NewHostId:        change.HostId,
-						}, state_store)
+					/* Load balancer registration waits for the app to be ready, see SyncLoadBalancers */
+					if change.JobId != "" {
+						state_store.AddJobRun(change.JobId, host.Id, changeId, time.Now())
 					}
 
 					cloud_provider.ActionChange(&model.ChangeServer{
@@ -309,6 +407,14 @@ func main() {
 						HostId:  change.HostId,
 					})
 
+					if change.Reason != "" {
+						state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+							Message: change.Reason,
+							AppId:   change.ApplicationName,
+							HostId:  change.HostId,
+						})
+					}
+
 					host, _ := state_store.GetConfiguration(change.HostId)
 					app, _ := store.GetConfiguration(change.ApplicationName)
 					host.Changes = append(host.Changes, model.ChangeApplication{
@@ -320,22 +426,6 @@ func main() {
 						Time:      time.Now().Format(time.RFC3339Nano),
 					})
 
-					for _, elb := range app.GetLatestConfiguration().LoadBalancer {
-						state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-							Message: fmt.Sprintf("Deregistering host %s with load balancer %s for application %s", change.HostId, elb.Domain, change.ApplicationName),
-							AppId:   change.ApplicationName,
-							HostId:  change.HostId,
-						})
-
-						cloud_provider.ActionChange(&model.ChangeServer{
-							Id:               uuid.NewV4().String(),
-							Type:             "loadbalancer_leave",
-							Time:             time.Now().Format(time.RFC3339Nano),
-							LoadBalancerName: elb.Domain,
-							NewHostId:        change.HostId,
-						}, state_store)
-					}
-
 					cloud_provider.ActionChange(&model.ChangeServer{
 						Id:                    uuid.NewV4().String(),
 						Type:                  "app_tag_remove",
@@ -373,6 +463,15 @@ func main() {
 					continue
 				}
 			}
+
+			/* Hosts with a remove_application planned just now leave their load balancers straight away */
+			cloud_provider.SyncLoadBalancers(*store, state_store)
+
+			if err := state_store.SaveJobs(); err != nil {
+				state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+					Message: fmt.Sprintf("JOB: Could not save the job history: %s", err),
+				})
+			}
 		}
 	}()
 
@@ -414,11 +513,32 @@ func main() {
 		for {
 			<-monitorTicker.C
 			// monitor queues
+			observedQueues := make(map[string]bool)
 			for _, appConfig := range store.GetAllConfiguration() {
 				config := appConfig.GetLatestConfiguration()
 				if config != nil {
 					for _, queue := range config.DataQueue {
-						monitor.Monit.DataQueue(&cloud_provider, queue)
+						depth := monitor.Monit.DataQueue(&cloud_provider, queue)
+						if depth >= 0 {
+							autoscaler.ObserveQueue(queue.Name, depth, time.Now())
+							observedQueues[queue.Name] = true
+						}
+					}
+				}
+			}
+
+			// queues used for scaling but without an alert threshold still need polling
+			for _, appConfig := range store.GetAllConfiguration() {
+				if !appConfig.QueueAutoscale.Enabled {
+					continue
+				}
+
+				queueName := scaling.QueueName(appConfig)
+				if queueName != "" && !observedQueues[queueName] {
+					depth := cloud_provider.MonitorQueue(queueName)
+					if depth >= 0 {
+						autoscaler.ObserveQueue(queueName, depth, time.Now())
+						observedQueues[queueName] = true
 					}
 				}
 			}
@@ -427,9 +547,23 @@ func main() {
 			for _, host := range state_store.GetAllRunningHosts() {
 				monitor.Monit.HostHDD(host)
 			}
+
+			// follow app readiness in the load balancers
+			cloud_provider.SyncLoadBalancers(*store, state_store)
 		}
 	}()
 
+	/* Run the apps checks from here too, so a host reporting a broken app as running is caught */
+	if store.GlobalSettings.ProbeInterval > 0 {
+		probeTicker := time.NewTicker(time.Second * time.Duration(store.GlobalSettings.ProbeInterval))
+		go func() {
+			for {
+				<-probeTicker.C
+				prober.Run(time.Now())
+			}
+		}()
+	}
+
 	/* tart logging endpoint */
 	channel := make(syslog.LogPartsChannel)
 	handler := syslog.NewChannelHandler(channel)
@@ -458,5 +592,5 @@ func main() {
 	}(channel)
 
 	api := api.Api{}
-	api.Init(store.GlobalSettings.ApiPort, store, state_store, &cloud_provider)
+	api.Init(store.GlobalSettings.ApiPort, store, state_store, &cloud_provider, &plannerEngine)
 }
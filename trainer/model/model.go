@@ -21,9 +21,11 @@ package model
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"orca/trainer/schedule"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ChangeApplication struct {
@@ -35,6 +37,9 @@ type ChangeApplication struct {
 
 	/* This could be nil/empty if not needed */
 	AppConfig VersionConfig
+
+	/* Jobs are run once and left stopped, not restarted like services */
+	RunToCompletion bool
 }
 
 type ChangeServer struct {
@@ -43,6 +48,7 @@ type ChangeServer struct {
 	Time                     string
 	NewHostId                string
 	RequiresReliableInstance bool
+	RequiresSpotInstance     bool
 	Network                  string
 	SecurityGroups           []SecurityGroup
 
@@ -57,9 +63,13 @@ type ChangeServer struct {
 	LoadBalancerAppTarget  string
 	LoadBalancerAppVersion string
 
+	//Application the planner requested this server for, empty if unknown
+	ApplicationName string
+
 	//Other stuff
 	GroupingTag string
 	InstanceType string
+	Labels       map[string]string
 }
 
 type HostResources struct {
@@ -71,6 +81,9 @@ type Application struct {
 	Version  string
 	ChangeId string
 
+	/* Jobs report State exited with the exit code of their container */
+	ExitCode int
+
 	Metrics Metric
 }
 
@@ -110,12 +123,37 @@ type Host struct {
 
 	InstanceType   string
 	SpotInstanceId string
+	Requested      string /* When the planner asked for this server, cleared once an app start has been timed from it */
 	GroupingTag    string
+	Labels         map[string]string
+
+	/* Cordoned hosts get no new apps, draining hosts also have their apps moved elsewhere */
+	Cordoned bool
+	Draining bool
+
+	/* Results of the trainers own checks, by app name */
+	Probes map[string]*AppProbe
+}
+
+/* What the trainer saw when it ran the apps checks itself, Failing is set once ConsecutiveFailures reaches the threshold */
+type AppProbe struct {
+	Version             string
+	Failing             bool
+	ConsecutiveFailures int
+	LatencyMs           int64
+	LastError           string
+	LastProbe           string
+}
+
+/* The trainers own checks overrule a host that says a failing app is running */
+func (host *Host) probeFailing(name string, version string) bool {
+	probe, ok := host.Probes[name]
+	return ok && probe.Version == version && probe.Failing
 }
 
 func (host *Host) HasAppRunning(name string) bool {
 	for _, runningApplicationState := range host.Apps {
-		if runningApplicationState.Name == name && runningApplicationState.State == "running" {
+		if runningApplicationState.Name == name && runningApplicationState.State == "running" && !host.probeFailing(name, runningApplicationState.Version) {
 			return true
 		}
 	}
@@ -152,7 +190,7 @@ func (host *Host) GetChange(id string) *ChangeApplication {
 
 func (host *Host) HasAppWithSameVersionRunning(name string, version string) bool {
 	for _, runningApplicationState := range host.Apps {
-		if runningApplicationState.Name == name && runningApplicationState.Version == version && runningApplicationState.State == "running" {
+		if runningApplicationState.Name == name && runningApplicationState.Version == version && runningApplicationState.State == "running" && !host.probeFailing(name, version) {
 			return true
 		}
 	}
@@ -179,7 +217,7 @@ func (host *Host) HasAppWithDifferentVersion(name string, version string) bool {
 
 func (host *Host) HasAppWithSameVersionFailing(name string, version string) bool {
 	for _, runningApplicationState := range host.Apps {
-		if runningApplicationState.Name == name && runningApplicationState.Version == version && runningApplicationState.State != "running" {
+		if runningApplicationState.Name == name && runningApplicationState.Version == version && (runningApplicationState.State != "running" || host.probeFailing(name, version)) {
 			return true
 		}
 	}
@@ -243,13 +281,134 @@ type SecurityGroup struct {
 	Group string
 }
 
+const (
+	CHECK__HTTP = "HTTP"
+	CHECK__TCP  = "TCP"
+)
+
 type ApplicationChecks struct {
 	Type string /* Either HTTP or TCP */
 	Goal string /* Either a port or uri */
 }
 
-type AffinityTag struct {
-	Tag string
+const (
+	LABEL__EQUALS = "equals"
+	LABEL__IN     = "in"
+	LABEL__NOT_IN = "notin"
+	LABEL__EXISTS = "exists"
+)
+
+type LabelSelector struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+func (selector *LabelSelector) Matches(labels map[string]string) bool {
+	value, exists := labels[selector.Key]
+
+	switch selector.Operator {
+	case LABEL__EQUALS:
+		return exists && len(selector.Values) > 0 && value == selector.Values[0]
+	case LABEL__IN:
+		if !exists {
+			return false
+		}
+		for _, candidate := range selector.Values {
+			if value == candidate {
+				return true
+			}
+		}
+		return false
+	case LABEL__NOT_IN:
+		if !exists {
+			return true
+		}
+		for _, candidate := range selector.Values {
+			if value == candidate {
+				return false
+			}
+		}
+		return true
+	case LABEL__EXISTS:
+		return exists
+	}
+
+	/* Unknown operators never match, its safer to not place an app than to place it wrong */
+	return false
+}
+
+type PreferredLabelSelector struct {
+	Weight   int
+	Selector LabelSelector
+}
+
+type Placement struct {
+	Required  []LabelSelector
+	Preferred []PreferredLabelSelector
+}
+
+func (placement *Placement) IsEmpty() bool {
+	return len(placement.Required) == 0 && len(placement.Preferred) == 0
+}
+
+func (placement *Placement) MatchesRequired(labels map[string]string) bool {
+	for _, selector := range placement.Required {
+		if !selector.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (placement *Placement) Score(labels map[string]string) int {
+	score := 0
+	for _, preferred := range placement.Preferred {
+		if preferred.Selector.Matches(labels) {
+			score += preferred.Weight
+		}
+	}
+	return score
+}
+
+/* The smallest set of labels a new server needs to satisfy the required terms, not-in is satisfied by leaving the label off */
+func (placement *Placement) RequiredLabels() map[string]string {
+	labels := make(map[string]string)
+	for _, selector := range placement.Required {
+		switch selector.Operator {
+		case LABEL__EQUALS, LABEL__IN:
+			if len(selector.Values) > 0 {
+				labels[selector.Key] = selector.Values[0]
+			}
+		case LABEL__EXISTS:
+			if _, exists := labels[selector.Key]; !exists {
+				labels[selector.Key] = "true"
+			}
+		}
+	}
+	return labels
+}
+
+/* Nil slices stay nil so publishing does not see a difference against older configurations */
+func (placement *Placement) Copy() Placement {
+	res := Placement{}
+
+	if placement.Required != nil {
+		res.Required = make([]LabelSelector, len(placement.Required))
+		for i, selector := range placement.Required {
+			res.Required[i] = selector
+			res.Required[i].Values = append([]string{}, selector.Values...)
+		}
+	}
+
+	if placement.Preferred != nil {
+		res.Preferred = make([]PreferredLabelSelector, len(placement.Preferred))
+		for i, preferred := range placement.Preferred {
+			res.Preferred[i] = preferred
+			res.Preferred[i].Selector.Values = append([]string{}, preferred.Selector.Values...)
+		}
+	}
+	return res
 }
 
 type VersionConfig struct {
@@ -267,11 +426,22 @@ type VersionConfig struct {
 	Checks               []ApplicationChecks
 	GroupingTag          string
 
+	/* When set this replaces the GroupingTag equality check */
+	Placement Placement
+
 	AppliedPropertyGroups map[string]int
 
 	DeploymentFailures int
 	DeploymentSuccess  int
 	InstanceType	string
+
+	/* Manual overrides of the deployment counters, set through the api */
+	KnownBad  bool
+	KnownGood bool
+
+	/* Version this configuration was rolled back from, empty for normal publishes */
+	RollbackOf      string
+	RollbackHandled bool
 }
 
 func (config *VersionConfig) GetVersion() int {
@@ -279,6 +449,19 @@ func (config *VersionConfig) GetVersion() int {
 	return version
 }
 
+/* A version is bad once it has failed twice without ever succeeding, unless someone has told us otherwise */
+func (config *VersionConfig) IsBad() bool {
+	if config.KnownBad {
+		return true
+	}
+
+	if config.KnownGood {
+		return false
+	}
+
+	return config.DeploymentFailures >= 2 && config.DeploymentSuccess == 0
+}
+
 func (config *VersionConfig) AsString() string {
 	res, _ := json.MarshalIndent(config, "", "  ")
 	return string(res)
@@ -303,21 +486,344 @@ type Dependency struct {
 	Name string
 }
 
+/* Zero means no limit. TopologyKey names a host label, replicas are then counted per value of that label */
+type SpreadConstraints struct {
+	MaxPerHost        int
+	MaxPerNetwork     int
+	MaxPerGroupingTag int
+	TopologyKey       string
+	MaxPerTopology    int
+}
+
+type AntiAffinity struct {
+	Name string
+}
+
+const (
+	AUTOSCALE__CPU     = "cpu"
+	AUTOSCALE__MEMORY  = "memory"
+	AUTOSCALE__NETWORK = "network"
+)
+
+/* Target is the average value of the metric we want per instance, cooldowns and windows are in seconds */
+type AutoscalePolicy struct {
+	Enabled      bool
+	Metric       string
+	Target       int64
+	MinInstances int
+	MaxInstances int
+
+	ScaleUpCooldown   int64
+	ScaleDownCooldown int64
+
+	ScaleUpStabilisationWindow   int64
+	ScaleDownStabilisationWindow int64
+}
+
+/* Sizes a consumer from the depth of its queue, Queue defaults to the first consumed DataQueue. Cooldowns are in seconds */
+type QueueAutoscalePolicy struct {
+	Enabled             bool
+	Queue               string
+	MessagesPerInstance int
+	MinInstances        int
+	MaxInstances        int
+
+	ScaleUpCooldown   int64
+	ScaleDownCooldown int64
+
+	/* Zero disables, otherwise we drop to zero instances once the queue has been empty this long */
+	ScaleToZeroAfter int64
+}
+
+/* How far ahead of a scheduled increase we start adding capacity, in seconds */
+type PreScalePolicy struct {
+	LeadTime int64
+
+	/* Use the measured time from asking for capacity to the app running, LeadTime covers us until there is a measurement */
+	Learn           bool
+	LearnedLeadTime int64
+}
+
+const (
+	APPLICATION__SERVICE = ""
+	APPLICATION__JOB     = "job"
+	APPLICATION__DAEMON  = "daemon"
+)
+
+/* A job runs its latest published version to completion, Deadline is in seconds */
+type JobSpec struct {
+	Completions int /* Successful runs needed, each on its own host. Zero means one */
+	Parallelism int /* Runs at the same time. Zero means one */
+	RetryLimit  int /* Failed runs allowed before the whole job fails */
+	Deadline    int64
+}
+
+func (spec JobSpec) NeededCompletions() int {
+	if spec.Completions <= 0 {
+		return 1
+	}
+	return spec.Completions
+}
+
+func (spec JobSpec) RunsAtOnce() int {
+	if spec.Parallelism <= 0 {
+		return 1
+	}
+	return spec.Parallelism
+}
+
+func (spec JobSpec) Validate() error {
+	if spec.Completions < 0 || spec.Parallelism < 0 || spec.RetryLimit < 0 || spec.Deadline < 0 {
+		return errors.New("Job completions, parallelism, retry limit and deadline cannot be negative")
+	}
+	return nil
+}
+
+const (
+	CONCURRENCY__ALLOW   = "allow"
+	CONCURRENCY__FORBID  = "forbid"
+	CONCURRENCY__REPLACE = "replace"
+)
+
+/*
+	Starts a job of the app each time Schedule fires in Timezone.
+	LastScheduleTime is saved with the configuration, so a trainer that was down starts the latest run it missed,
+	unless that is more than StartingDeadline seconds late. Zero StartingDeadline always catches up.
+*/
+type CronJobPolicy struct {
+	Schedule               string
+	Timezone               string
+	ConcurrencyPolicy      string /* What to do with a run still going when the next is due. Defaults to CONCURRENCY__ALLOW */
+	StartingDeadline       int64
+	SuccessfulHistoryLimit int /* Finished jobs kept, zero means 3 */
+	FailedHistoryLimit     int /* Failed jobs kept, zero means 1 */
+	FailureWebhook         string
+	LastScheduleTime       time.Time
+}
+
+func (policy CronJobPolicy) IsEmpty() bool {
+	return policy.Schedule == ""
+}
+
+func (policy CronJobPolicy) Trigger() schedule.CronTrigger {
+	return schedule.CronTrigger{Expression: policy.Schedule, Timezone: policy.Timezone}
+}
+
+func (policy CronJobPolicy) Concurrency() string {
+	if policy.ConcurrencyPolicy == "" {
+		return CONCURRENCY__ALLOW
+	}
+	return policy.ConcurrencyPolicy
+}
+
+func (policy CronJobPolicy) SuccessfulHistory() int {
+	if policy.SuccessfulHistoryLimit <= 0 {
+		return 3
+	}
+	return policy.SuccessfulHistoryLimit
+}
+
+func (policy CronJobPolicy) FailedHistory() int {
+	if policy.FailedHistoryLimit <= 0 {
+		return 1
+	}
+	return policy.FailedHistoryLimit
+}
+
+func (policy CronJobPolicy) Validate() error {
+	if policy.IsEmpty() {
+		return nil
+	}
+
+	switch policy.Concurrency() {
+	case CONCURRENCY__ALLOW, CONCURRENCY__FORBID, CONCURRENCY__REPLACE:
+	default:
+		return errors.New("Unknown concurrency policy " + policy.ConcurrencyPolicy)
+	}
+
+	if policy.StartingDeadline < 0 || policy.SuccessfulHistoryLimit < 0 || policy.FailedHistoryLimit < 0 {
+		return errors.New("Cron starting deadline and history limits cannot be negative")
+	}
+	return policy.Trigger().Validate()
+}
+
+const (
+	SPOT__DEFAULT    = ""
+	SPOT__NEVER      = "never"
+	SPOT__ONLY       = "only"
+	SPOT__PERCENTAGE = "percentage"
+	SPOT__COUNT      = "count"
+)
+
+/*
+	How an apps replicas are split between spot and reliable hosts. The default keeps the min count on reliable hosts
+	and lets everything above it go to spot. ReliabilityFloor is the number of replicas moved onto reliable hosts
+	while spot capacity cannot be had, it does nothing in the default mode.
+*/
+type SpotPolicy struct {
+	Mode             string
+	Percentage       int
+	Count            int
+	ReliabilityFloor int
+}
+
+func (policy *SpotPolicy) Validate() error {
+	switch policy.Mode {
+	case SPOT__DEFAULT, SPOT__NEVER, SPOT__ONLY, SPOT__COUNT:
+	case SPOT__PERCENTAGE:
+		if policy.Percentage < 0 || policy.Percentage > 100 {
+			return errors.New("Spot percentage must be between 0 and 100")
+		}
+	default:
+		return errors.New("Unknown spot policy mode " + policy.Mode)
+	}
+
+	if policy.Count < 0 || policy.ReliabilityFloor < 0 {
+		return errors.New("Spot count and reliability floor cannot be negative")
+	}
+	return nil
+}
+
 type ApplicationConfiguration struct {
 	Name               string
+	Type               string /* APPLICATION__SERVICE, APPLICATION__JOB or APPLICATION__DAEMON */
+	Job                JobSpec
+	Cron               CronJobPolicy
 	MinDeployment      int
 	DesiredDeployment  int
+	MaxDeployment      int /* Zero means no limit */
 	DisableSchedule    bool
 	DeploymentSchedule schedule.DeploymentSchedule
 	ScheduleParts      []schedule.DeploymentSchedulePart
+
+	/* When set, drives MinDeployment the way DeploymentSchedule drives DesiredDeployment, zero included */
+	MinSchedule schedule.DeploymentSchedule
+
+	/* New versions are only published inside these windows, rollbacks go out straight away */
+	Maintenance schedule.MaintenanceWindows
 	Config             map[string]*VersionConfig
 	PublishedConfig    map[string]*VersionConfig
 
-	Enabled bool
-	Publish bool
+	Enabled      bool
+	Publish      bool
+	AutoRollback bool
+
+	/* Higher priorities are placed first and may evict lower ones when we are out of servers */
+	Priority int
+
+	SpotPolicy SpotPolicy
 
 	PropertyGroups []UsedPropertyGroup
 	Depends        []Dependency
+
+	Spread       SpreadConstraints
+	AntiAffinity []AntiAffinity
+
+	Autoscale      AutoscalePolicy
+	QueueAutoscale QueueAutoscalePolicy
+	PreScale       PreScalePolicy
+}
+
+/* Caps a replica count at MaxDeployment */
+func (app *ApplicationConfiguration) CapDeployment(count int) int {
+	if app.MaxDeployment > 0 && count > app.MaxDeployment {
+		return app.MaxDeployment
+	}
+	return count
+}
+
+func (app *ApplicationConfiguration) TargetMinDeployment() int {
+	return app.CapDeployment(app.MinDeployment)
+}
+
+func (app *ApplicationConfiguration) TargetDesiredDeployment() int {
+	return app.CapDeployment(app.DesiredDeployment)
+}
+
+/* Catches the schedule typo that asks for 500 instead of 5 before it spawns hundreds of servers */
+func (app *ApplicationConfiguration) ValidateDeploymentLimits() error {
+	if app.MaxDeployment < 0 {
+		return errors.New("Max deployment cannot be negative")
+	}
+
+	if app.MaxDeployment == 0 {
+		return nil
+	}
+
+	if app.MinDeployment > app.MaxDeployment {
+		return fmt.Errorf("Min deployment %d exceeds max deployment %d", app.MinDeployment, app.MaxDeployment)
+	}
+
+	if app.DesiredDeployment > app.MaxDeployment {
+		return fmt.Errorf("Desired deployment %d exceeds max deployment %d", app.DesiredDeployment, app.MaxDeployment)
+	}
+
+	if app.MinSchedule.Max() > app.MaxDeployment {
+		return fmt.Errorf("Min schedule asks for %d which exceeds max deployment %d", app.MinSchedule.Max(), app.MaxDeployment)
+	}
+
+	if app.DeploymentSchedule.Max() > app.MaxDeployment {
+		return fmt.Errorf("Deployment schedule asks for %d which exceeds max deployment %d", app.DeploymentSchedule.Max(), app.MaxDeployment)
+	}
+
+	for _, part := range app.ScheduleParts {
+		if part.Desired > app.MaxDeployment {
+			return fmt.Errorf("Schedule part %d asks for %d which exceeds max deployment %d", part.Id, part.Desired, app.MaxDeployment)
+		}
+	}
+
+	if app.Autoscale.Enabled && app.Autoscale.MaxInstances > app.MaxDeployment {
+		return fmt.Errorf("Autoscale max instances %d exceeds max deployment %d", app.Autoscale.MaxInstances, app.MaxDeployment)
+	}
+
+	if app.QueueAutoscale.Enabled && app.QueueAutoscale.MaxInstances > app.MaxDeployment {
+		return fmt.Errorf("Queue autoscale max instances %d exceeds max deployment %d", app.QueueAutoscale.MaxInstances, app.MaxDeployment)
+	}
+	return nil
+}
+
+/* Rebuilds the weekly grid from ScheduleParts, apps without parts keep the grid they were given */
+func (app *ApplicationConfiguration) CompileSchedule() error {
+	if len(app.ScheduleParts) == 0 {
+		return nil
+	}
+	return app.DeploymentSchedule.CompileParts(app.ScheduleParts)
+}
+
+/* Learned lead times are capped, a bad measurement should not have us scaling up hours ahead */
+const MAX_LEARNED_LEAD_TIME = time.Hour
+
+func (app *ApplicationConfiguration) LeadTime() time.Duration {
+	if app.PreScale.Learn && app.PreScale.LearnedLeadTime > 0 {
+		learned := time.Duration(app.PreScale.LearnedLeadTime) * time.Second
+		if learned > MAX_LEARNED_LEAD_TIME {
+			return MAX_LEARNED_LEAD_TIME
+		}
+		return learned
+	}
+	return time.Duration(app.PreScale.LeadTime) * time.Second
+}
+
+/* Jobs are left to Plan_RunJobs and daemons to Plan_Daemons, every other stage only looks after services */
+func (app *ApplicationConfiguration) IsService() bool {
+	return app.Type == APPLICATION__SERVICE
+}
+
+func (app *ApplicationConfiguration) IsJob() bool {
+	return app.Type == APPLICATION__JOB
+}
+
+func (app *ApplicationConfiguration) IsDaemon() bool {
+	return app.Type == APPLICATION__DAEMON
+}
+
+/* Cron jobs are started by their schedule, not by publishing a version */
+func (app *ApplicationConfiguration) IsCronJob() bool {
+	return app.IsJob() && !app.Cron.IsEmpty()
+}
+
+func (app *ApplicationConfiguration) IsAutoscaled() bool {
+	return app.Autoscale.Enabled || app.QueueAutoscale.Enabled
 }
 
 func (app *ApplicationConfiguration) GetLatestVersion() string {
@@ -344,6 +850,27 @@ func (app *ApplicationConfiguration) GetLatestPublishedVersion() string {
 	return strconv.Itoa(version)
 }
 
+func (app *ApplicationConfiguration) GetLastGoodPublishedConfiguration() *VersionConfig {
+	latest := app.GetLatestPublishedConfiguration()
+
+	var lastGood *VersionConfig
+	for _, config := range app.PublishedConfig {
+		if config == latest || config.KnownBad {
+			continue
+		}
+
+		if !config.KnownGood && config.DeploymentSuccess == 0 {
+			continue
+		}
+
+		if lastGood == nil || config.GetVersion() > lastGood.GetVersion() {
+			lastGood = config
+		}
+	}
+
+	return lastGood
+}
+
 func (app *ApplicationConfiguration) GetSuitableNextVersion() string {
 	version := 0
 	for v, _ := range app.Config {
@@ -389,6 +916,18 @@ func (config *VersionConfig) ApplyPropertyGroup(name string, prop *PropertyGroup
 		config.DockerConfig.Username = strings.Replace(config.DockerConfig.Username, "%"+property.Key+"%", property.Value, -1)
 
 		config.GroupingTag = strings.Replace(config.GroupingTag, "%"+property.Key+"%", property.Value, -1)
+
+		for i, selector := range config.Placement.Required {
+			for j, value := range selector.Values {
+				config.Placement.Required[i].Values[j] = strings.Replace(value, "%"+property.Key+"%", property.Value, -1)
+			}
+		}
+
+		for i, preferred := range config.Placement.Preferred {
+			for j, value := range preferred.Selector.Values {
+				config.Placement.Preferred[i].Selector.Values[j] = strings.Replace(value, "%"+property.Key+"%", property.Value, -1)
+			}
+		}
 		config.Network = strings.Replace(config.Network, "%"+property.Key+"%", property.Value, -1)
 
 		/* Iterate over the files and perform replacement */
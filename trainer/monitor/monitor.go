@@ -75,13 +75,14 @@ func (monitor *Monitor) monitDataQueue(name string, alertThreshold int, numMsgs
 
 }
 
-func (monitor *Monitor) DataQueue(cloudProvider *cloud.CloudProvider, queue model.DataQueue) {
+/* Returns the depth of the main queue, or -1 if it was not polled */
+func (monitor *Monitor) DataQueue(cloudProvider *cloud.CloudProvider, queue model.DataQueue) int {
 	// monitor main queue
 	if len(queue.AlertThreshold) > 0 {
 		alertThreshold, err := strconv.Atoi(queue.AlertThreshold)
 		if err != nil {
 			fmt.Println(err)
-			return
+			return -1
 		}
 		numMsgs := cloudProvider.MonitorQueue(queue.Name)
 		if numMsgs >= 0 {
@@ -92,13 +93,15 @@ func (monitor *Monitor) DataQueue(cloudProvider *cloud.CloudProvider, queue mode
 				rogueAlertThreshold, err := strconv.Atoi(queue.RogueAlertThreshold)
 				if err != nil {
 					fmt.Println(err)
-					return
+					return numMsgs
 				}
 				rogueNumMsgs := cloudProvider.MonitorQueue(queue.RogueName)
 				monitor.monitDataQueue(queue.RogueName, rogueAlertThreshold, rogueNumMsgs)
 			}
 		}
+		return numMsgs
 	}
+	return -1
 }
 
 func (monitor *Monitor) monitHostHDD(monitorKey string, usage int64, usageThreshold int64) {
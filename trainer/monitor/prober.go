@@ -0,0 +1,325 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* One app on one host to probe, copied out of the state so the probe goroutine never touches it */
+type probeTarget struct {
+	HostId       string
+	Ip           string
+	Application  string
+	Version      string
+	Checks       []model.ApplicationChecks
+	PortMappings []model.PortMapping
+}
+
+type probeResult struct {
+	probeTarget
+	Err     error
+	Latency time.Duration
+	Time    time.Time
+}
+
+/*
+	Runs the ApplicationChecks of the apps on a host from the trainer, against the hosts ip and the host port the
+	checked container port is mapped to. The host agent runs the same checks, so when the two disagree an alarm is raised.
+
+	Only Collect and Apply touch the state, and both are called from the planner loop. Run does the network
+	calls on its own goroutine and hands its results over under probeLock, like the scalers queue observations.
+*/
+type Prober struct {
+	Timeout   time.Duration
+	Threshold int
+
+	/*
+		Probe failures count towards DeploymentFailures, and so IsBad and auto rollback, unless the settings opt out.
+		A network partition between the trainer and the hosts fails every probe, which would roll back healthy releases.
+	*/
+	CountFailures bool
+
+	/* Swapped out in tests */
+	runCheck func(check model.ApplicationChecks, address string, timeout time.Duration) error
+
+	probeLock sync.Mutex
+	targets   []probeTarget
+	results   []probeResult
+
+	alarms map[string]*MonitorState
+}
+
+func (prober *Prober) Init(settings configuration.GlobalSettings) {
+	prober.Timeout = time.Duration(settings.ProbeTimeout) * time.Second
+	if prober.Timeout <= 0 {
+		prober.Timeout = 5 * time.Second
+	}
+
+	prober.Threshold = settings.ProbeFailureThreshold
+	if prober.Threshold <= 0 {
+		prober.Threshold = 3
+	}
+
+	prober.CountFailures = !settings.ProbeFailuresIgnoredByRollback
+	prober.runCheck = runCheck
+	prober.alarms = make(map[string]*MonitorState)
+}
+
+/* The host port a container port is published on, ports that are not mapped are used as they are */
+func mappedPort(portMappings []model.PortMapping, port string) string {
+	for _, mapping := range portMappings {
+		if mapping.ContainerPort == port {
+			return mapping.HostPort
+		}
+	}
+	return port
+}
+
+/* A TCP check is host:port, an HTTP check a url. HTTP goals without a port go to the first mapped port */
+func checkAddress(ip string, portMappings []model.PortMapping, check model.ApplicationChecks) (string, error) {
+	if ip == "" {
+		return "", errors.New("host has no ip")
+	}
+
+	switch check.Type {
+	case model.CHECK__TCP:
+		return net.JoinHostPort(ip, mappedPort(portMappings, check.Goal)), nil
+	case model.CHECK__HTTP:
+		goal := check.Goal
+		if !strings.Contains(goal, "://") {
+			goal = "http://localhost/" + strings.TrimPrefix(goal, "/")
+		}
+
+		uri, err := url.Parse(goal)
+		if err != nil {
+			return "", err
+		}
+
+		port := uri.Port()
+		if port != "" {
+			port = mappedPort(portMappings, port)
+		} else if len(portMappings) > 0 {
+			port = portMappings[0].HostPort
+		} else {
+			port = "80"
+		}
+		uri.Host = net.JoinHostPort(ip, port)
+		return uri.String(), nil
+	}
+	return "", errors.New("unknown check type " + check.Type)
+}
+
+func runCheck(check model.ApplicationChecks, address string, timeout time.Duration) error {
+	if check.Type == model.CHECK__TCP {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := http.Client{Timeout: timeout}
+	res, err := client.Get(address)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %d", address, res.StatusCode)
+	}
+	return nil
+}
+
+/* Every check of the version has to pass, the first to fail is reported */
+func (prober *Prober) probe(target probeTarget) error {
+	for _, check := range target.Checks {
+		address, err := checkAddress(target.Ip, target.PortMappings, check)
+		if err != nil {
+			return err
+		}
+
+		if err := prober.runCheck(check, address, prober.Timeout); err != nil {
+			return fmt.Errorf("%s check %s failed, %s", check.Type, check.Goal, err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+	Planner loop. Picks the apps the agents have started that declare checks, for the next Run,
+	and drops the probes of apps that have gone from their host.
+*/
+func (prober *Prober) Collect(stateStore *state.StateStore, configurationStore configuration.ConfigurationStore) {
+	targets := make([]probeTarget, 0)
+	for _, host := range stateStore.GetAllRunningHosts() {
+		probes := make(map[string]*model.AppProbe)
+		for _, app := range host.Apps {
+			if probe, ok := host.Probes[app.Name]; ok && probe.Version == app.Version {
+				probes[app.Name] = probe
+			}
+
+			if app.State != "running" && app.State != "checks_failed" {
+				continue
+			}
+
+			appConfiguration, err := configurationStore.GetConfiguration(app.Name)
+			if err != nil {
+				continue
+			}
+
+			config := appConfiguration.PublishedConfig[app.Version]
+			if config == nil || len(config.Checks) == 0 {
+				continue
+			}
+
+			targets = append(targets, probeTarget{
+				HostId:       host.Id,
+				Ip:           host.Ip,
+				Application:  app.Name,
+				Version:      app.Version,
+				Checks:       append([]model.ApplicationChecks{}, config.Checks...),
+				PortMappings: append([]model.PortMapping{}, config.PortMappings...),
+			})
+		}
+		host.Probes = probes
+	}
+
+	prober.probeLock.Lock()
+	prober.targets = targets
+	prober.probeLock.Unlock()
+}
+
+/* Probe goroutine. Runs the checks of the last collected targets and queues the results for Apply */
+func (prober *Prober) Run(now time.Time) {
+	prober.probeLock.Lock()
+	targets := prober.targets
+	prober.probeLock.Unlock()
+
+	results := make([]probeResult, 0)
+	for _, target := range targets {
+		started := time.Now()
+		err := prober.probe(target)
+		results = append(results, probeResult{probeTarget: target, Err: err, Latency: time.Since(started), Time: now})
+	}
+
+	prober.probeLock.Lock()
+	prober.results = append(prober.results, results...)
+	prober.probeLock.Unlock()
+}
+
+/* Planner loop. Records the queued results against hosts still running the version that was probed */
+func (prober *Prober) Apply(stateStore *state.StateStore, configurationStore configuration.ConfigurationStore) {
+	prober.probeLock.Lock()
+	results := prober.results
+	prober.results = nil
+	prober.probeLock.Unlock()
+
+	for _, result := range results {
+		host, err := stateStore.GetConfiguration(result.HostId)
+		if err != nil {
+			continue
+		}
+
+		app, err := host.GetApp(result.Application)
+		if err != nil || app.Version != result.Version {
+			continue
+		}
+
+		appConfiguration, err := configurationStore.GetConfiguration(result.Application)
+		if err != nil || appConfiguration.PublishedConfig[result.Version] == nil {
+			continue
+		}
+
+		if host.Probes == nil {
+			host.Probes = make(map[string]*model.AppProbe)
+		}
+
+		probe := host.Probes[app.Name]
+		if probe == nil || probe.Version != app.Version {
+			probe = &model.AppProbe{Version: app.Version}
+			host.Probes[app.Name] = probe
+		}
+
+		probe.LatencyMs = int64(result.Latency / time.Millisecond)
+		probe.LastProbe = result.Time.Format(time.RFC3339Nano)
+		prober.record(host, app, appConfiguration.PublishedConfig[result.Version], probe, result.Err)
+		prober.compare(host, app, probe)
+	}
+}
+
+/* Once it crosses the threshold the failure is audited, and counted against the version unless CountFailures was turned off */
+func (prober *Prober) record(host *model.Host, app model.Application, config *model.VersionConfig, probe *model.AppProbe, err error) {
+	if err == nil {
+		if probe.Failing {
+			state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+				Message: fmt.Sprintf("PROBE: Application %s on host %s is passing the trainers checks again", app.Name, host.Id),
+				HostId:  host.Id,
+				AppId:   app.Name,
+			})
+		}
+		probe.Failing = false
+		probe.ConsecutiveFailures = 0
+		probe.LastError = ""
+		return
+	}
+
+	probe.ConsecutiveFailures += 1
+	probe.LastError = err.Error()
+	if !probe.Failing && probe.ConsecutiveFailures >= prober.Threshold {
+		probe.Failing = true
+		if prober.CountFailures {
+			config.DeploymentFailures += 1
+		}
+
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__ERROR,
+			Message: fmt.Sprintf("PROBE: Application %s on host %s failed the trainers checks %d times in a row, %s", app.Name, host.Id, probe.ConsecutiveFailures, probe.LastError),
+			HostId:  host.Id,
+			AppId:   app.Name,
+		})
+	}
+}
+
+/* Alarms while the host and the trainer disagree about whether the app is healthy */
+func (prober *Prober) compare(host *model.Host, app model.Application, probe *model.AppProbe) {
+	name := fmt.Sprintf("PROBE_%s_%s", app.Name, host.Id)
+	alarm, ok := prober.alarms[name]
+	if !ok {
+		alarm = &MonitorState{Name: name}
+		prober.alarms[name] = alarm
+	}
+
+	disagree := (app.State == "running") == probe.Failing
+	if disagree != alarm.Alarm {
+		alarm.Alarm = disagree
+		alarm.StringValue = fmt.Sprintf("host reports %s, trainer checks failing: %t", app.State, probe.Failing)
+		Monit.Alert(alarm)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package monitor
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"testing"
+	"time"
+)
+
+func TestProber_FailingChecksOverruleTheHost(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !healthy {
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	versionConfig := make(map[string]*model.VersionConfig)
+	versionConfig["1"] = &model.VersionConfig{
+		Version:      "1",
+		PortMappings: []model.PortMapping{{HostPort: port, ContainerPort: "8080"}},
+		Checks: []model.ApplicationChecks{
+			{Type: model.CHECK__HTTP, Goal: "http://localhost:8080/health"},
+			{Type: model.CHECK__TCP, Goal: "8080"},
+		},
+	}
+	config.Add("app1", &model.ApplicationConfiguration{Name: "app1", PublishedConfig: versionConfig})
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+	host := &model.Host{Id: "host1", Ip: "127.0.0.1", State: "running", Apps: []model.Application{{Name: "app1", Version: "1", State: "running"}}}
+	stateStore.Add("host1", host)
+
+	prober := Prober{}
+	prober.Init(config.GlobalSettings)
+	if !prober.CountFailures {
+		t.Error("probe failures do not count towards rollback by default")
+	}
+	probe := func() {
+		prober.Collect(&stateStore, config)
+		prober.Run(time.Now())
+		prober.Apply(&stateStore, config)
+	}
+
+	probe()
+	if probe := host.Probes["app1"]; probe == nil || probe.Failing || probe.ConsecutiveFailures != 0 || !host.HasAppRunning("app1") {
+		t.Fatalf("%+v", probe)
+	}
+
+	/* The host still says running, the trainer only believes it until the threshold */
+	healthy = false
+	for i := 0; i < prober.Threshold; i++ {
+		if !host.HasAppRunning("app1") {
+			t.Errorf("failing after %d probes", i)
+		}
+		probe()
+	}
+	if host.HasAppRunning("app1") || !host.HasAppWithSameVersionFailing("app1", "1") || versionConfig["1"].DeploymentFailures != 1 {
+		t.Errorf("%+v %+v", host.Probes["app1"], versionConfig["1"])
+	}
+
+	/* Results for a version the host has moved off are dropped */
+	prober.Collect(&stateStore, config)
+	host.Apps[0].Version = "2"
+	prober.Run(time.Now())
+	prober.Apply(&stateStore, config)
+	host.Apps[0].Version = "1"
+	if host.Probes["app1"].ConsecutiveFailures != prober.Threshold {
+		t.Errorf("%+v", host.Probes["app1"])
+	}
+	if !prober.alarms["PROBE_app1_host1"].Alarm {
+		t.Error("no alarm while the host and the trainer disagree")
+	}
+
+	healthy = true
+	probe()
+	if !host.HasAppRunning("app1") || prober.alarms["PROBE_app1_host1"].Alarm {
+		t.Errorf("%+v", host.Probes["app1"])
+	}
+
+	/* Opting out still marks the app failing, but leaves the version alone */
+	prober.CountFailures = false
+	healthy = false
+	for i := 0; i < prober.Threshold; i++ {
+		probe()
+	}
+	if !host.HasAppWithSameVersionFailing("app1", "1") || versionConfig["1"].DeploymentFailures != 1 {
+		t.Errorf("%+v %+v", host.Probes["app1"], versionConfig["1"])
+	}
+}
+
+func TestProber_CheckAddress(t *testing.T) {
+	portMappings := []model.PortMapping{{HostPort: "32000", ContainerPort: "80"}}
+
+	for goal, expected := range map[string]string{
+		"/status":                "http://10.0.0.1:32000/status",
+		"http://localhost/ready": "http://10.0.0.1:32000/ready",
+		"http://localhost:9000/": "http://10.0.0.1:9000/",
+	} {
+		if address, err := checkAddress("10.0.0.1", portMappings, model.ApplicationChecks{Type: model.CHECK__HTTP, Goal: goal}); err != nil || address != expected {
+			t.Errorf("%s: %s %v", goal, address, err)
+		}
+	}
+
+	if address, _ := checkAddress("10.0.0.1", portMappings, model.ApplicationChecks{Type: model.CHECK__TCP, Goal: "80"}); address != "10.0.0.1:32000" {
+		t.Error(address)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"orca/trainer/model"
 	"orca/trainer/state"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/twinj/uuid"
@@ -43,6 +45,27 @@ func (s ByApplicationCount) Less(i, j int) bool {
 	return len(s.Hosts[i].Apps) < len(s.Hosts[j].Apps)
 }
 
+type ApplicationsByPriority []*model.ApplicationConfiguration
+
+func (s ApplicationsByPriority) Len() int {
+	return len(s)
+}
+func (s ApplicationsByPriority) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ApplicationsByPriority) Less(i, j int) bool {
+	return s[i].Priority > s[j].Priority
+}
+
+type ByPlacementScore struct {
+	Hosts
+	Placement *model.Placement
+}
+
+func (s ByPlacementScore) Less(i, j int) bool {
+	return s.Placement.Score(s.Hosts[i].Labels) > s.Placement.Score(s.Hosts[j].Labels)
+}
+
 type BoringPlanner struct {
 	AppChangeTimeout       int64
 	ServerChangeTimeout    int64
@@ -50,6 +73,30 @@ type BoringPlanner struct {
 	HostChangeFailureLimit int64
 	ServerTTL              int64
 	ServerCapacity         int64
+	MaxHostCount           int64
+	MaxInstancesPerHost    int64
+
+	/* Server changes the cloud provider is still working on */
+	ServerChanges []*model.ChangeServer
+
+	/* Set when the cloud provider has recently failed to get us spot instances */
+	SpotUnavailable bool
+
+	/* Replaced when replaying a snapshot so the same input always gives the same plan, and leaves the audit log alone */
+	NewId func() string
+	Now   func() time.Time
+	Audit func(event state.AuditEvent)
+
+	/* Moves still to be carried out to free up hosts, kept across ticks */
+	consolidation *consolidation
+
+	/* Held while Plan runs, so the api can read what Plan carries between ticks */
+	planLock sync.Mutex
+
+	/* Decisions of the plan in progress, and the last PLAN_HISTORY_LENGTH plans */
+	decisions   []PlanDecision
+	historyLock sync.Mutex
+	history     []PlanRecord
 }
 
 func (bp *BoringPlanner) Init(globalConfig configuration.GlobalSettings) {
@@ -59,29 +106,67 @@ func (bp *BoringPlanner) Init(globalConfig configuration.GlobalSettings) {
 	bp.HostChangeFailureLimit = globalConfig.HostChangeFailureLimit
 	bp.ServerTTL = globalConfig.ServerTTL
 	bp.ServerCapacity = globalConfig.ServerCapacity
+	bp.MaxHostCount = globalConfig.MaxHostCount
+	bp.MaxInstancesPerHost = globalConfig.MaxInstancesPerHost
+	bp.NewId = func() string {
+		return uuid.NewV4().String()
+	}
+	bp.Now = time.Now
 }
 
-func hostIsSuitable(host *model.Host, app *model.ApplicationConfiguration) bool {
+func (planner *BoringPlanner) newId() string {
+	if planner.NewId == nil {
+		return uuid.NewV4().String()
+	}
+	return planner.NewId()
+}
+
+func (planner *BoringPlanner) now() time.Time {
+	if planner.Now == nil {
+		return time.Now()
+	}
+	return planner.Now()
+}
+
+func (planner *BoringPlanner) audit(event state.AuditEvent) {
+	if planner.Audit == nil {
+		state.Audit.Insert__AuditEvent(event)
+		return
+	}
+	planner.Audit(event)
+}
+
+/* Why the host cannot run this app at all, empty when it can */
+func hostUnsuitableReason(host *model.Host, app *model.ApplicationConfiguration) string {
 	if host.State != "running" {
-		return false
+		return fmt.Sprintf("host is %s", host.State)
+	}
+
+	if host.Cordoned {
+		return "host is cordoned"
 	}
 
 	if host.Network != app.GetLatestPublishedConfiguration().Network {
-		return false
+		return fmt.Sprintf("network %s does not match %s", host.Network, app.GetLatestPublishedConfiguration().Network)
 	}
 
-	count := 0
 	for _, appGrp := range app.GetLatestPublishedConfiguration().SecurityGroups {
+		found := false
 		for _, hostGrp := range host.SecurityGroups {
 			if appGrp.Group == hostGrp.Group {
-				count += 1
+				found = true
 			}
 		}
+
+		if !found {
+			return fmt.Sprintf("missing security group %s", appGrp.Group)
+		}
 	}
-	if count == len(app.GetLatestPublishedConfiguration().SecurityGroups) {
-		return true
-	}
-	return false
+	return ""
+}
+
+func hostIsSuitable(host *model.Host, app *model.ApplicationConfiguration) bool {
+	return hostUnsuitableReason(host, app) == ""
 }
 
 func securityGroupsMatch(a []model.SecurityGroup, b []model.SecurityGroup) bool {
@@ -98,29 +183,349 @@ func securityGroupsMatch(a []model.SecurityGroup, b []model.SecurityGroup) bool
 	return true
 }
 
-/* Well this is rather nasty aint it */
+/* Apps without a placement still use the old GroupingTag equality */
+func labelsMatchPlacement(labels map[string]string, groupingTag string, app *model.ApplicationConfiguration) bool {
+	config := app.GetLatestPublishedConfiguration()
+	if config.Placement.IsEmpty() {
+		return groupingTag == config.GroupingTag
+	}
+
+	return config.Placement.MatchesRequired(labels)
+}
+
 func (planner *BoringPlanner) hostHasCorrectAffinity(host *model.Host, app *model.ApplicationConfiguration) bool {
-	return host.GroupingTag == app.GetLatestPublishedConfiguration().GroupingTag
+	return labelsMatchPlacement(host.Labels, host.GroupingTag, app)
 }
 
-func (planner *BoringPlanner) hostHasCapacity(host *model.Host, configurationStore configuration.ConfigurationStore) bool {
-	return int64(len(host.Apps)) < planner.ServerCapacity
+/* Hosts matching more of the apps preferred terms are tried first */
+func (planner *BoringPlanner) hostsByPreference(hosts []*model.Host, app *model.ApplicationConfiguration) []*model.Host {
+	sortedHosts := append(Hosts{}, hosts...)
+
+	sort.Stable(ByPlacementScore{sortedHosts, &app.GetLatestPublishedConfiguration().Placement})
+	return sortedHosts
 }
 
-func (planner *BoringPlanner) isMinSatisfied(applicationConfiguration *model.ApplicationConfiguration, currentState *state.StateStore) bool {
+/* Adds and removes already planned this round count towards the hosts capacity, daemons do not count at all */
+func (planner *BoringPlanner) hostHasCapacity(host *model.Host, configurationStore configuration.ConfigurationStore, planned []PlanningChange) bool {
+	count := int64(0)
+	for _, app := range host.Apps {
+		if !isDaemon(configurationStore, app.Name) {
+			count += 1
+		}
+	}
+
+	for _, change := range planned {
+		if change.HostId != host.Id || isDaemon(configurationStore, change.ApplicationName) {
+			continue
+		}
+
+		if change.Type == "add_application" {
+			count += 1
+		} else if change.Type == "remove_application" {
+			count -= 1
+		}
+	}
+	return count < planner.ServerCapacity
+}
+
+/* Hosts, servers still launching and servers planned this round all count against MaxHostCount */
+func (planner *BoringPlanner) fleetHasRoom(currentState *state.StateStore, planned []PlanningChange) bool {
+	if planner.MaxHostCount <= 0 {
+		return true
+	}
+
+	count := int64(len(currentState.GetAllHosts()))
+	for _, change := range planner.ServerChanges {
+		if change.Type == "new_server" && change.NewHostId == "" {
+			count += 1
+		}
+	}
+
+	for _, change := range planned {
+		if change.Type == "new_server" {
+			count += 1
+		}
+	}
+	return count < planner.MaxHostCount
+}
+
+/* Without an override the app can go on the default type, or on any catalog type big enough for it */
+func (planner *BoringPlanner) hostHasCorrectInstanceType(host *model.Host, app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore) bool {
+	if app.GetLatestPublishedConfiguration().InstanceType != "" {
+		return host.InstanceType == app.GetLatestPublishedConfiguration().InstanceType
+	}
+
+	if entry, ok := configurationStore.GlobalSettings.CatalogEntry(host.InstanceType); ok {
+		return entryFits(entry, []*model.ApplicationConfiguration{app})
+	}
+	return host.InstanceType == configurationStore.GlobalSettings.InstanceType
+}
+
+/* Why the Min and Desired stages will not add the app to this host, empty when they will */
+func (planner *BoringPlanner) hostRejection(host *model.Host, app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore, currentState *state.StateStore, planned []PlanningChange, kind hostKind) string {
+	if reason := hostUnsuitableReason(host, app); reason != "" {
+		return reason
+	}
+
+	if reason := kindRejection(host, kind); reason != "" {
+		return reason
+	}
+
+	if !planner.hostHasCorrectAffinity(host, app) {
+		return "affinity does not match"
+	}
+
+	if !planner.hostHasCapacity(host, configurationStore, planned) {
+		return "host is at capacity"
+	}
+
+	if !planner.hostSatisfiesSpread(host, app, currentState, planned, "") {
+		return "spread constraints"
+	}
+
+	if !planner.hostSatisfiesAntiAffinity(host, app, configurationStore, planned) {
+		return "anti affinity"
+	}
+
+	if !planner.hostHasCorrectInstanceType(host, app, configurationStore) {
+		return fmt.Sprintf("instance type %s does not match", host.InstanceType)
+	}
+
+	if host.HasAppWithSameVersionRunning(app.Name, app.GetLatestPublishedVersion()) {
+		return "already running this version"
+	}
+	return ""
+}
+
+/* Apps in dependency order, with higher priorities moved to the front */
+func appsByPriority(configurationStore configuration.ConfigurationStore) []*model.ApplicationConfiguration {
+	apps := configurationStore.GetAllConfigurationAsOrderedList()
+	sort.Stable(ApplicationsByPriority(apps))
+	return apps
+}
+
+/*
+	Used when no host has room for the app and no new server can be launched.
+	Picks the lowest priority app on a full host the app could otherwise use, and swaps it out.
+*/
+func (planner *BoringPlanner) preempt(app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore, currentState *state.StateStore, planned []PlanningChange, kind hostKind) []PlanningChange {
+	var victimHost *model.Host
+	var victim *model.ApplicationConfiguration
+
+	for _, hostEntity := range planner.hostsByPreference(currentState.ListOfHosts(), app) {
+		if !hostIsSuitable(hostEntity, app) || kindRejection(hostEntity, kind) != "" {
+			continue
+		}
+
+		if planner.hostHasCapacity(hostEntity, configurationStore, planned) {
+			continue
+		}
+
+		if !planner.hostHasCorrectAffinity(hostEntity, app) || !planner.hostHasCorrectInstanceType(hostEntity, app, configurationStore) {
+			continue
+		}
+
+		if !planner.hostSatisfiesSpread(hostEntity, app, currentState, planned, "") || !planner.hostSatisfiesAntiAffinity(hostEntity, app, configurationStore, planned) {
+			continue
+		}
+
+		if hostEntity.HasApp(app.Name) {
+			continue
+		}
+
+		for _, hostApp := range hostEntity.Apps {
+			candidate, err := configurationStore.GetConfiguration(hostApp.Name)
+			if err != nil || candidate.Priority >= app.Priority || !candidate.IsService() {
+				continue
+			}
+
+			alreadyEvicted := false
+			for _, change := range planned {
+				if change.Type == "remove_application" && change.HostId == hostEntity.Id && change.ApplicationName == candidate.Name {
+					alreadyEvicted = true
+				}
+			}
+
+			if !alreadyEvicted && (victim == nil || candidate.Priority < victim.Priority) {
+				victim = candidate
+				victimHost = hostEntity
+			}
+		}
+	}
+
+	if victim == nil {
+		return nil
+	}
+
+	return []PlanningChange{
+		{
+			Type:            "remove_application",
+			ApplicationName: victim.Name,
+			HostId:          victimHost.Id,
+			Id:              planner.newId(),
+			Reason: fmt.Sprintf("PREEMPTION: Application %s (priority %d) evicted from host %s to make room for %s (priority %d), no new server could be launched",
+				victim.Name, victim.Priority, victimHost.Id, app.Name, app.Priority),
+		},
+		{
+			Type:            "add_application",
+			ApplicationName: app.Name,
+			HostId:          victimHost.Id,
+			Id:              planner.newId(),
+		},
+	}
+}
+
+/* Counts instances of the current version of an app on hosts accepted by the filter, including adds already planned in this round */
+func countAppInstances(app *model.ApplicationConfiguration, currentState *state.StateStore, planned []PlanningChange, excludeHostId string, filter func(host *model.Host) bool) int {
+	count := 0
+	for _, hostEntity := range currentState.ListOfHosts() {
+		if hostEntity.Id == excludeHostId || !filter(hostEntity) {
+			continue
+		}
+
+		if hostEntity.HasAppWithSameVersion(app.Name, app.GetLatestPublishedVersion()) {
+			count += 1
+		}
+	}
+
+	for _, change := range planned {
+		if change.Type != "add_application" || change.ApplicationName != app.Name {
+			continue
+		}
+
+		hostEntity, err := currentState.GetConfiguration(change.HostId)
+		if err == nil && hostEntity.Id != excludeHostId && filter(hostEntity) {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+/* Can another replica of this app go onto this host without breaking the apps spread rules? */
+func (planner *BoringPlanner) hostSatisfiesSpread(host *model.Host, app *model.ApplicationConfiguration, currentState *state.StateStore, planned []PlanningChange, excludeHostId string) bool {
+	maxPerHost := app.Spread.MaxPerHost
+	if maxPerHost == 0 {
+		maxPerHost = int(planner.MaxInstancesPerHost)
+	}
+
+	if maxPerHost > 0 {
+		if countAppInstances(app, currentState, planned, excludeHostId, func(other *model.Host) bool { return other.Id == host.Id }) >= maxPerHost {
+			return false
+		}
+	}
+
+	if app.Spread.MaxPerNetwork > 0 {
+		if countAppInstances(app, currentState, planned, excludeHostId, func(other *model.Host) bool { return other.Network == host.Network }) >= app.Spread.MaxPerNetwork {
+			return false
+		}
+	}
+
+	if app.Spread.MaxPerGroupingTag > 0 {
+		if countAppInstances(app, currentState, planned, excludeHostId, func(other *model.Host) bool { return other.GroupingTag == host.GroupingTag }) >= app.Spread.MaxPerGroupingTag {
+			return false
+		}
+	}
+
+	return spreadAllowsTopology(app, host.Labels, currentState, planned, excludeHostId)
+}
+
+/* Hosts without the topology label share the empty domain */
+func spreadAllowsTopology(app *model.ApplicationConfiguration, labels map[string]string, currentState *state.StateStore, planned []PlanningChange, excludeHostId string) bool {
+	key := app.Spread.TopologyKey
+	if key == "" || app.Spread.MaxPerTopology <= 0 {
+		return true
+	}
+
+	domain := labels[key]
+	return countAppInstances(app, currentState, planned, excludeHostId, func(other *model.Host) bool { return other.Labels[key] == domain }) < app.Spread.MaxPerTopology
+}
+
+/* A new server lands in the apps network and grouping tag with the labels its placement requires, so only those limits can stop us from spawning one */
+func (planner *BoringPlanner) spreadAllowsNewServer(app *model.ApplicationConfiguration, currentState *state.StateStore, planned []PlanningChange) bool {
+	if app.Spread.MaxPerNetwork > 0 {
+		network := app.GetLatestPublishedConfiguration().Network
+		if countAppInstances(app, currentState, planned, "", func(other *model.Host) bool { return other.Network == network }) >= app.Spread.MaxPerNetwork {
+			return false
+		}
+	}
+
+	if app.Spread.MaxPerGroupingTag > 0 {
+		groupingTag := app.GetLatestPublishedConfiguration().GroupingTag
+		if countAppInstances(app, currentState, planned, "", func(other *model.Host) bool { return other.GroupingTag == groupingTag }) >= app.Spread.MaxPerGroupingTag {
+			return false
+		}
+	}
+
+	return spreadAllowsTopology(app, app.GetLatestPublishedConfiguration().Placement.RequiredLabels(), currentState, planned, "")
+}
+
+func appsAreAntiAffine(a *model.ApplicationConfiguration, b *model.ApplicationConfiguration) bool {
+	for _, other := range a.AntiAffinity {
+		if other.Name == b.Name {
+			return true
+		}
+	}
+
+	for _, other := range b.AntiAffinity {
+		if other.Name == a.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* Anti affinity works both ways, if either app names the other they may not share a host */
+func (planner *BoringPlanner) hostSatisfiesAntiAffinity(host *model.Host, app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore, planned []PlanningChange) bool {
+	appsOnHost := make([]string, 0)
+	for _, hostApp := range host.Apps {
+		appsOnHost = append(appsOnHost, hostApp.Name)
+	}
+
+	for _, change := range planned {
+		if change.Type == "add_application" && change.HostId == host.Id {
+			appsOnHost = append(appsOnHost, change.ApplicationName)
+		}
+	}
+
+	for _, name := range appsOnHost {
+		if name == app.Name {
+			continue
+		}
+
+		otherApp, err := configurationStore.GetConfiguration(name)
+		if err != nil {
+			continue
+		}
+
+		if appsAreAntiAffine(app, otherApp) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Instances of the latest version, apps on draining hosts are already on their way out so they do not count */
+func (planner *BoringPlanner) deployedCount(applicationConfiguration *model.ApplicationConfiguration, currentState *state.StateStore) int {
 	instanceCount := 0
-	for _, hostEntity := range currentState.GetAllRunningHosts() {
-		if hostEntity.SpotInstance {
+	for _, hostEntity := range currentState.ListOfHosts() {
+		if hostEntity.Draining {
 			continue
 		}
 
-		/* Only use reserved instances when working with the min count */
 		if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
 			instanceCount += 1
 		}
 	}
+	return instanceCount
+}
 
-	return instanceCount >= applicationConfiguration.MinDeployment
+/* Min is met once the spot policy has its reliable replicas and there are at least MinDeployment replicas overall */
+func (planner *BoringPlanner) isMinSatisfied(applicationConfiguration *model.ApplicationConfiguration, currentState *state.StateStore) bool {
+	_, needed := planner.minReplicaKind(applicationConfiguration, currentState)
+	return !needed
 }
 
 func (planner *BoringPlanner) canDeploy(applicationConfiguration *model.ApplicationConfiguration) bool {
@@ -128,15 +533,44 @@ func (planner *BoringPlanner) canDeploy(applicationConfiguration *model.Applicat
 		return false
 	}
 
-	if applicationConfiguration.GetLatestPublishedConfiguration().DeploymentFailures >= 2 && applicationConfiguration.GetLatestPublishedConfiguration().DeploymentSuccess == 0 {
+	if applicationConfiguration.GetLatestPublishedConfiguration().IsBad() {
 		return false
 	}
 
 	return true
 }
 
+/* Dependencies that do not yet have their min count running on their current published version */
+func UnsatisfiedDependencies(app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore, currentState *state.StateStore) []string {
+	ret := make([]string, 0)
+	for _, dependency := range app.Depends {
+		dependencyConfiguration, err := configurationStore.GetConfiguration(dependency.Name)
+		if err != nil {
+			ret = append(ret, dependency.Name)
+			continue
+		}
+
+		count := 0
+		for _, hostEntity := range currentState.ListOfHosts() {
+			if hostEntity.HasAppWithSameVersionRunning(dependencyConfiguration.Name, dependencyConfiguration.GetLatestPublishedVersion()) {
+				count += 1
+			}
+		}
+
+		if count < dependencyConfiguration.TargetMinDeployment() {
+			ret = append(ret, dependency.Name)
+		}
+	}
+	return ret
+}
+
 func (planner *BoringPlanner) FindServerInChanges(changes []PlanningChange, app *model.ApplicationConfiguration) bool {
-	for _, newServerChange := range changes {
+	return planner.findServerInChanges(changes, app) >= 0
+}
+
+/* Index of a planned new server the app could also use, -1 if there is none */
+func (planner *BoringPlanner) findServerInChanges(changes []PlanningChange, app *model.ApplicationConfiguration) int {
+	for i, newServerChange := range changes {
 		if newServerChange.Type != "new_server" {
 			continue
 		}
@@ -153,21 +587,22 @@ func (planner *BoringPlanner) FindServerInChanges(changes []PlanningChange, app
 			continue
 		}
 
-		if newServerChange.GroupingTag != app.GetLatestPublishedConfiguration().GroupingTag {
+		if !labelsMatchPlacement(newServerChange.Labels, newServerChange.GroupingTag, app) {
 			continue
 		}
 
-		return true
+		return i
 	}
 
-	return false
+	return -1
 }
 
 func (planner *BoringPlanner) Plan_SatisfyMinNeeds(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
+	serverApps := make(map[string][]*model.ApplicationConfiguration)
 
-	for _, applicationConfiguration := range configurationStore.GetAllConfigurationAsOrderedList() {
-		if !applicationConfiguration.Enabled {
+	for _, applicationConfiguration := range appsByPriority(configurationStore) {
+		if !applicationConfiguration.Enabled || !applicationConfiguration.IsService() {
 			continue
 		}
 
@@ -175,44 +610,24 @@ func (planner *BoringPlanner) Plan_SatisfyMinNeeds(configurationStore configurat
 			continue
 		}
 
-		if !planner.isMinSatisfied(applicationConfiguration, &currentState) {
-			foundServer := false
-			for _, hostEntity := range currentState.GetAllRunningHosts() {
-				/* Only use reserved instances when working with the min count */
-				if !hostIsSuitable(hostEntity, applicationConfiguration) {
-					continue
-				}
-
-				if hostEntity.SpotInstance {
-					continue
-				}
-
-				if !planner.hostHasCorrectAffinity(hostEntity, applicationConfiguration) {
-					continue
-				}
-
-				if !planner.hostHasCapacity(hostEntity, configurationStore) {
-					continue
-				}
+		if len(UnsatisfiedDependencies(applicationConfiguration, configurationStore, &currentState)) > 0 {
+			continue
+		}
 
-				/* Does this application override the normal instance type */
-				if applicationConfiguration.GetLatestPublishedConfiguration().InstanceType != "" {
-					if hostEntity.InstanceType != applicationConfiguration.GetLatestPublishedConfiguration().InstanceType {
-						continue
-					}
-				}else{
-					if hostEntity.InstanceType != configurationStore.GlobalSettings.InstanceType {
-						continue
-					}
-				}
+		if kind, needed := planner.minReplicaKind(applicationConfiguration, &currentState); needed {
+			decision := PlanDecision{ApplicationName: applicationConfiguration.Name}
+			foundServer := false
+			for _, hostEntity := range planner.hostsByPreference(currentState.ListOfHosts(), applicationConfiguration) {
+				/* Reliable replicas only go on reserved instances */
+				rejected := planner.hostRejection(hostEntity, applicationConfiguration, configurationStore, &currentState, ret, kind)
 
-				/* If this host already has this application version and its running avoid */
-				if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
-					continue
+				/* If this host has an older version of the app running, avoid */
+				if rejected == "" && hostEntity.HasAppWithDifferentVersion(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) && hostEntity.HasAppRunning(applicationConfiguration.Name) {
+					rejected = "an older version is still running"
 				}
 
-				/* If this host has an older version of the app running, avoid */
-				if hostEntity.HasAppWithDifferentVersion(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) && hostEntity.HasAppRunning(applicationConfiguration.Name) {
+				decision.Considered = append(decision.Considered, HostConsideration{HostId: hostEntity.Id, Rejected: rejected})
+				if rejected != "" {
 					continue
 				}
 
@@ -221,34 +636,74 @@ func (planner *BoringPlanner) Plan_SatisfyMinNeeds(configurationStore configurat
 					1) This host does not have an older version of the app running
 					2) This host does not have the same version of the app running
 					3) This means either the app is not installed on this host, or a failing version is
-					4) This host is not a spot instance
+					4) This host is the kind of instance the spot policy asks for
 				*/
 				change := PlanningChange{
 					Type:            "add_application",
 					ApplicationName: applicationConfiguration.Name,
 					HostId:          hostEntity.Id,
-					Id:              uuid.NewV4().String(),
+					Id:              planner.newId(),
 				}
 
 				ret = append(ret, change)
+				decision.Chosen = hostEntity.Id
 				foundServer = true
 				break
 			}
 
-			if !foundServer && !planner.FindServerInChanges(ret, applicationConfiguration) {
+			if foundServer {
+				planner.decide(decision)
+				continue
+			}
+
+			if index := planner.findServerInChanges(ret, applicationConfiguration); index >= 0 {
+				serverApps[ret[index].Id] = append(serverApps[ret[index].Id], applicationConfiguration)
+				decision.Reason = "a server planned this round will take it"
+			} else if !planner.spreadAllowsNewServer(applicationConfiguration, &currentState, ret) {
+				decision.Reason = "spread constraints do not allow a new server"
+			} else if kind == SPOT_HOST && planner.SpotUnavailable {
+				/* No spot server can be launched, so take the place of something less important like at MaxHostCount */
+				preemption := planner.preempt(applicationConfiguration, configurationStore, &currentState, ret, kind)
+				ret = extend(ret, preemption)
+				decision.Reason = "spot capacity is unavailable and the spot policy has no reliability floor left"
+				if preemption != nil {
+					decision.Chosen = preemption[1].HostId
+					decision.Reason = preemption[0].Reason
+				}
+			} else if !planner.fleetHasRoom(&currentState, ret) {
+				preemption := planner.preempt(applicationConfiguration, configurationStore, &currentState, ret, kind)
+				ret = extend(ret, preemption)
+				decision.Reason = "fleet is at MaxHostCount and nothing can be preempted"
+				if preemption != nil {
+					decision.Chosen = preemption[1].HostId
+					decision.Reason = preemption[0].Reason
+				}
+			} else {
 				/* Search through the current changes and check to see if it will work */
 				change := PlanningChange{
 					Type: "new_server",
-					Id:   uuid.NewV4().String(),
-					RequiresReliableInstance: true,
+					Id:   planner.newId(),
+					ApplicationName:          applicationConfiguration.Name,
 					Network:                  applicationConfiguration.GetLatestPublishedConfiguration().Network,
 					SecurityGroups:           applicationConfiguration.GetLatestPublishedConfiguration().SecurityGroups,
 					GroupingTag:              applicationConfiguration.GetLatestPublishedConfiguration().GroupingTag,
 					InstanceType:             applicationConfiguration.GetLatestPublishedConfiguration().InstanceType,
+					Labels:                   applicationConfiguration.GetLatestPublishedConfiguration().Placement.RequiredLabels(),
 				}
+				requestInstanceKind(&change, kind)
 
 				ret = append(ret, change)
+				serverApps[change.Id] = []*model.ApplicationConfiguration{applicationConfiguration}
+				decision.Chosen = NEW_SERVER_DECISION
+				decision.Reason = "no existing host can take it"
 			}
+			planner.decide(decision)
+		}
+	}
+
+	for i := range ret {
+		if ret[i].Type == "new_server" {
+			planner.selectInstanceType(&ret[i], serverApps[ret[i].Id], configurationStore.GlobalSettings)
 		}
 	}
 
@@ -258,14 +713,18 @@ func (planner *BoringPlanner) Plan_SatisfyMinNeeds(configurationStore configurat
 func (planner *BoringPlanner) Plan_SatisfyDesiredNeeds(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	requiresSpotServer := false
+	requiresServer := false
+	serverKind := ANY_HOST
 	serverNetwork := ""
 	groupingTag := ""
 	instanceType := ""
+	var labels map[string]string
+	serverApplication := ""
 	var serverSecurityGroups []model.SecurityGroup
+	wantingServer := make([]*model.ApplicationConfiguration, 0)
 
-	for _, applicationConfiguration := range configurationStore.GetAllConfigurationAsOrderedList() {
-		if !applicationConfiguration.Enabled {
+	for _, applicationConfiguration := range appsByPriority(configurationStore) {
+		if !applicationConfiguration.Enabled || !applicationConfiguration.IsService() {
 			continue
 		}
 
@@ -273,41 +732,23 @@ func (planner *BoringPlanner) Plan_SatisfyDesiredNeeds(configurationStore config
 			continue
 		}
 
-		currentCount := 0
-		for _, hostEntity := range currentState.GetAllRunningHosts() {
-			if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
-				currentCount += 1
-			}
+		if len(UnsatisfiedDependencies(applicationConfiguration, configurationStore, &currentState)) > 0 {
+			continue
 		}
 
-		//spawn to desired
-		if currentCount >= applicationConfiguration.MinDeployment && currentCount < applicationConfiguration.DesiredDeployment {
-			foundServer := false
-			for _, hostEntity := range currentState.GetAllRunningHosts() {
-				if !hostIsSuitable(hostEntity, applicationConfiguration) {
-					continue
-				}
-
-				if !planner.hostHasCorrectAffinity(hostEntity, applicationConfiguration) {
-					continue
-				}
-
-				if !planner.hostHasCapacity(hostEntity, configurationStore) {
-					continue
-				}
+		currentCount := planner.deployedCount(applicationConfiguration, &currentState)
 
-				/* Does this application override the normal instance type */
-				if applicationConfiguration.GetLatestPublishedConfiguration().InstanceType != "" {
-					if hostEntity.InstanceType != applicationConfiguration.GetLatestPublishedConfiguration().InstanceType {
-						continue
-					}
-				}else{
-					if hostEntity.InstanceType != configurationStore.GlobalSettings.InstanceType {
-						continue
-					}
-				}
+		//spawn to desired
+		if currentCount >= applicationConfiguration.TargetMinDeployment() && currentCount < applicationConfiguration.TargetDesiredDeployment() {
+			_, spotCount := planner.replicaCounts(applicationConfiguration, &currentState)
+			kind := planner.extraReplicaKind(applicationConfiguration, spotCount)
 
-				if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
+			decision := PlanDecision{ApplicationName: applicationConfiguration.Name}
+			foundServer := false
+			for _, hostEntity := range planner.hostsByPreference(currentState.ListOfHosts(), applicationConfiguration) {
+				rejected := planner.hostRejection(hostEntity, applicationConfiguration, configurationStore, &currentState, ret, kind)
+				decision.Considered = append(decision.Considered, HostConsideration{HostId: hostEntity.Id, Rejected: rejected})
+				if rejected != "" {
 					continue
 				}
 
@@ -315,34 +756,88 @@ func (planner *BoringPlanner) Plan_SatisfyDesiredNeeds(configurationStore config
 					Type:            "add_application",
 					ApplicationName: applicationConfiguration.Name,
 					HostId:          hostEntity.Id,
-					Id:              uuid.NewV4().String(),
+					Id:              planner.newId(),
 				}
 
 				ret = append(ret, change)
+				decision.Chosen = hostEntity.Id
 				foundServer = true
 				break
 			}
 
-			if !foundServer {
-				requiresSpotServer = true
-				serverNetwork = applicationConfiguration.GetLatestPublishedConfiguration().Network
-				serverSecurityGroups = applicationConfiguration.GetLatestPublishedConfiguration().SecurityGroups
-				groupingTag = applicationConfiguration.GetLatestPublishedConfiguration().GroupingTag
-				instanceType = applicationConfiguration.GetLatestPublishedConfiguration().InstanceType
+			if foundServer {
+				planner.decide(decision)
+				continue
+			}
+
+			if !planner.spreadAllowsNewServer(applicationConfiguration, &currentState, ret) {
+				decision.Reason = "spread constraints do not allow a new server"
+				planner.decide(decision)
+				continue
+			}
+
+			/* Without room for a spot server, try to take the place of something less important first */
+			if (kind != RELIABLE_HOST && planner.SpotUnavailable) || !planner.fleetHasRoom(&currentState, ret) {
+				preemption := planner.preempt(applicationConfiguration, configurationStore, &currentState, ret, kind)
+				if preemption != nil {
+					ret = extend(ret, preemption)
+					decision.Chosen = preemption[1].HostId
+					decision.Reason = preemption[0].Reason
+					planner.decide(decision)
+					continue
+				}
+
+				if !planner.fleetHasRoom(&currentState, ret) {
+					decision.Reason = "fleet is at MaxHostCount and nothing can be preempted"
+					planner.decide(decision)
+					continue
+				}
+
+				/* Other apps fall back to a reliable instance in the cloud provider */
+				if kind == SPOT_HOST {
+					decision.Reason = "spot capacity is unavailable and the spot policy has no reliability floor left"
+					planner.decide(decision)
+					continue
+				}
 			}
+
+			requiresServer = true
+			wantingServer = append(wantingServer, applicationConfiguration)
+			serverKind = kind
+			serverNetwork = applicationConfiguration.GetLatestPublishedConfiguration().Network
+			serverSecurityGroups = applicationConfiguration.GetLatestPublishedConfiguration().SecurityGroups
+			groupingTag = applicationConfiguration.GetLatestPublishedConfiguration().GroupingTag
+			instanceType = applicationConfiguration.GetLatestPublishedConfiguration().InstanceType
+			labels = applicationConfiguration.GetLatestPublishedConfiguration().Placement.RequiredLabels()
+			serverApplication = applicationConfiguration.Name
+
+			decision.Chosen = NEW_SERVER_DECISION
+			decision.Reason = "no existing host can take it, a new server was requested"
+			planner.decide(decision)
 		}
 	}
 
-	if requiresSpotServer {
+	if requiresServer {
 		change := PlanningChange{
 			Type: "new_server",
-			Id:   uuid.NewV4().String(),
-			RequiresReliableInstance: false,
+			Id:   planner.newId(),
+			ApplicationName:          serverApplication,
 			Network:                  serverNetwork,
 			SecurityGroups:           serverSecurityGroups,
 			GroupingTag:              groupingTag,
 			InstanceType:             instanceType,
+			Labels:                   labels,
+		}
+		requestInstanceKind(&change, serverKind)
+
+		/* Size the server for every app that wanted one and could use it */
+		serverApps := make([]*model.ApplicationConfiguration, 0)
+		for _, app := range wantingServer {
+			if planner.findServerInChanges([]PlanningChange{change}, app) >= 0 {
+				serverApps = append(serverApps, app)
+			}
 		}
+		planner.selectInstanceType(&change, serverApps, configurationStore.GlobalSettings)
 
 		ret = append(ret, change)
 	}
@@ -353,25 +848,25 @@ func (planner *BoringPlanner) Plan_SatisfyDesiredNeeds(configurationStore config
 func (planner *BoringPlanner) Plan_RemoveOldVersions(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 	for _, applicationConfiguration := range configurationStore.GetAllConfigurationAsOrderedList() {
-		if !applicationConfiguration.Enabled {
+		if !applicationConfiguration.Enabled || !applicationConfiguration.IsService() {
 			continue
 		}
 
 		currentCount := 0
-		for _, hostEntity := range currentState.GetAllRunningHosts() {
+		for _, hostEntity := range currentState.ListOfHosts() {
 			if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
 				currentCount += 1
 			}
 		}
 
-		if currentCount >= applicationConfiguration.DesiredDeployment && currentCount >= applicationConfiguration.MinDeployment {
-			for _, hostEntity := range currentState.GetAllRunningHosts() {
+		if currentCount >= applicationConfiguration.TargetDesiredDeployment() && currentCount >= applicationConfiguration.TargetMinDeployment() {
+			for _, hostEntity := range currentState.ListOfHosts() {
 				if hostEntity.HasApp(applicationConfiguration.Name) && !hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
 					change := PlanningChange{
 						Type:            "remove_application",
 						ApplicationName: applicationConfiguration.Name,
 						HostId:          hostEntity.Id,
-						Id:              uuid.NewV4().String(),
+						Id:              planner.newId(),
 					}
 
 					ret = append(ret, change)
@@ -386,23 +881,23 @@ func (planner *BoringPlanner) Plan_RemoveOldDesired(configurationStore configura
 	ret := make([]PlanningChange, 0)
 
 	sortedHosts := currentState.ListOfHosts()
-	sort.Sort(ByApplicationCount{sortedHosts})
+	sort.Stable(ByApplicationCount{sortedHosts})
 
 	for _, applicationConfiguration := range configurationStore.GetAllConfigurationAsOrderedList() {
-		if !applicationConfiguration.Enabled {
+		if !applicationConfiguration.Enabled || !applicationConfiguration.IsService() {
 			continue
 		}
 
-		currentCount := 0
-		for _, hostEntity := range sortedHosts {
-			if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
-				currentCount += 1
-			}
+		/* The new copy of a consolidation move runs above desired until Plan_Consolidate removes the old one */
+		if planner.isConsolidating(applicationConfiguration.Name, &currentState) {
+			continue
 		}
 
+		currentCount := planner.deployedCount(applicationConfiguration, &currentState)
+
 		/* Can we kill of some extra desired machines? */
-		if currentCount > applicationConfiguration.DesiredDeployment && currentCount > applicationConfiguration.MinDeployment {
-			if (applicationConfiguration.DesiredDeployment - applicationConfiguration.MinDeployment) > 0 {
+		if currentCount > applicationConfiguration.TargetDesiredDeployment() && currentCount > applicationConfiguration.TargetMinDeployment() {
+			if (applicationConfiguration.TargetDesiredDeployment() - applicationConfiguration.TargetMinDeployment()) > 0 {
 				/* Find potential spot instances */
 				terminateCandidateFound := false
 				for _, hostEntity := range sortedHosts {
@@ -412,7 +907,7 @@ func (planner *BoringPlanner) Plan_RemoveOldDesired(configurationStore configura
 								Type:            "remove_application",
 								ApplicationName: applicationConfiguration.Name,
 								HostId:          hostEntity.Id,
-								Id:              uuid.NewV4().String(),
+								Id:              planner.newId(),
 							}
 
 							ret = append(ret, change)
@@ -423,13 +918,13 @@ func (planner *BoringPlanner) Plan_RemoveOldDesired(configurationStore configura
 				}
 
 				if !terminateCandidateFound {
-					for _, hostEntity := range currentState.GetAllRunningHosts() {
+					for _, hostEntity := range currentState.ListOfHosts() {
 						if hostEntity.HasAppWithSameVersionRunning(applicationConfiguration.Name, applicationConfiguration.GetLatestPublishedVersion()) {
 							change := PlanningChange{
 								Type:            "remove_application",
 								ApplicationName: applicationConfiguration.Name,
 								HostId:          hostEntity.Id,
-								Id:              uuid.NewV4().String(),
+								Id:              planner.newId(),
 							}
 
 							ret = append(ret, change)
@@ -444,7 +939,7 @@ func (planner *BoringPlanner) Plan_RemoveOldDesired(configurationStore configura
 							Type:            "remove_application",
 							ApplicationName: applicationConfiguration.Name,
 							HostId:          hostEntity.Id,
-							Id:              uuid.NewV4().String(),
+							Id:              planner.newId(),
 						}
 
 						ret = append(ret, change)
@@ -460,12 +955,25 @@ func (planner *BoringPlanner) Plan_RemoveOldDesired(configurationStore configura
 func (planner *BoringPlanner) Plan_KullUnusedServers(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	for _, hostEntity := range currentState.GetAllRunningHosts() {
-		if len(hostEntity.Apps) == 0 {
+	for _, hostEntity := range currentState.ListOfHosts() {
+		/* Cordoned hosts are kept around for debugging even once empty */
+		if hostEntity.Cordoned {
+			continue
+		}
+
+		/* A host running nothing but daemons is unused */
+		unused := true
+		for _, app := range hostEntity.Apps {
+			if !isDaemon(configurationStore, app.Name) {
+				unused = false
+			}
+		}
+
+		if unused {
 			change := PlanningChange{
 				Type:   "kill_server",
 				HostId: hostEntity.Id,
-				Id:     uuid.NewV4().String(),
+				Id:     planner.newId(),
 				Reason: "Planner deemed this server to be unused, Plan_KullUnusedServers",
 			}
 
@@ -478,13 +986,13 @@ func (planner *BoringPlanner) Plan_KullUnusedServers(configurationStore configur
 func (planner *BoringPlanner) Plan_KullBrokenServers(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	for _, hostEntity := range currentState.GetAllRunningHosts() {
+	for _, hostEntity := range currentState.ListOfHosts() {
 		/* This server is messing up, changes are failing for some reason */
 		if hostEntity.NumberOfChangeFailuresInRow >= planner.HostChangeFailureLimit {
 			change := PlanningChange{
 				Type:   "kill_server",
 				HostId: hostEntity.Id,
-				Id:     uuid.NewV4().String(),
+				Id:     planner.newId(),
 				Reason: "Planner deemed this server to be broken, Plan_KullBrokenServers",
 			}
 
@@ -497,7 +1005,7 @@ func (planner *BoringPlanner) Plan_KullBrokenServers(configurationStore configur
 func (planner *BoringPlanner) Plan_KullBrokenApplications(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	for _, hostEntity := range currentState.GetAllRunningHosts() {
+	for _, hostEntity := range currentState.ListOfHosts() {
 		for _, application := range hostEntity.Apps {
 			if application.State != "running" {
 				/* This application is messing up, if we have gotten to this stage then the mins and desired have already been dealt with for it */
@@ -506,7 +1014,7 @@ func (planner *BoringPlanner) Plan_KullBrokenApplications(configurationStore con
 						Type:            "remove_application",
 						ApplicationName: application.Name,
 						HostId:          hostEntity.Id,
-						Id:              uuid.NewV4().String(),
+						Id:              planner.newId(),
 					}
 
 					ret = append(ret, change)
@@ -517,68 +1025,41 @@ func (planner *BoringPlanner) Plan_KullBrokenApplications(configurationStore con
 	return ret
 }
 
-func (planner *BoringPlanner) Plan_OptimiseLayout(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
+/*
+	Apps on a draining host do not count towards their deployment, so the Min and Desired stages place replacements elsewhere.
+	Once enough replacements are running the app is removed from the draining host, the host itself is left alone.
+*/
+func (planner *BoringPlanner) Plan_DrainHosts(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	sortedHosts := currentState.ListOfHosts()
-	sort.Sort(ByApplicationCount{sortedHosts})
-
-	for _, hostEntity := range sortedHosts {
+	for _, hostEntity := range currentState.ListOfHosts() {
+		if !hostEntity.Draining || hostEntity.State != "running" {
+			continue
+		}
 
 		for _, app := range hostEntity.Apps {
 			appConfiguration, err := configurationStore.GetConfiguration(app.Name)
-			if err != nil {
+
+			/* Jobs are left to finish, Plan_RunJobs removes them afterwards. Daemons stay with the host */
+			if err == nil && !appConfiguration.IsService() {
 				continue
 			}
 
-			/* Now search, can we move this application to any other machine ?*/
-			for _, potentialHost := range currentState.ListOfHosts() {
-				if potentialHost.Id == hostEntity.Id {
-					continue
-				}
-
-				if hostEntity.SpotInstance != potentialHost.SpotInstance {
+			if err == nil && appConfiguration.Enabled {
+				if !planner.isMinSatisfied(appConfiguration, &currentState) || planner.deployedCount(appConfiguration, &currentState) < appConfiguration.TargetDesiredDeployment() {
 					continue
 				}
+			}
 
-				/* Does this application override the normal instance type */
-				if appConfiguration.GetLatestPublishedConfiguration().InstanceType != "" {
-					if potentialHost.InstanceType != appConfiguration.GetLatestPublishedConfiguration().InstanceType {
-						continue
-					}
-				}else{
-					if potentialHost.InstanceType != configurationStore.GlobalSettings.InstanceType {
-						continue
-					}
-				}
-
-				if hostIsSuitable(potentialHost, appConfiguration) &&
-					!potentialHost.HasAppWithSameVersionRunning(app.Name, app.Version) &&
-					planner.hostHasCorrectAffinity(potentialHost, appConfiguration) &&
-					planner.hostHasCapacity(potentialHost, configurationStore) &&
-					len(potentialHost.Apps) >= len(hostEntity.Apps) {
-
-					change := PlanningChange{
-						Type:            "add_application",
-						ApplicationName: app.Name,
-						HostId:          potentialHost.Id,
-						Id:              uuid.NewV4().String(),
-					}
-
-					ret = append(ret, change)
-
-					change2 := PlanningChange{
-						Type:            "remove_application",
-						ApplicationName: app.Name,
-						HostId:          hostEntity.Id,
-						Id:              uuid.NewV4().String(),
-					}
-
-					ret = append(ret, change2)
-
-					return ret
-				}
+			change := PlanningChange{
+				Type:            "remove_application",
+				ApplicationName: app.Name,
+				HostId:          hostEntity.Id,
+				Id:              planner.newId(),
+				Reason:          fmt.Sprintf("DRAIN: Application %s removed from draining host %s, replacements are running elsewhere", app.Name, hostEntity.Id),
 			}
+
+			ret = append(ret, change)
 		}
 	}
 	return ret
@@ -587,17 +1068,17 @@ func (planner *BoringPlanner) Plan_OptimiseLayout(configurationStore configurati
 func (planner *BoringPlanner) Plan_KullServersExceedingTTL(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	for _, hostEntity := range currentState.GetAllRunningHosts() {
+	for _, hostEntity := range currentState.ListOfHosts() {
 		firstTimeParsed, _ := time.Parse(time.RFC3339Nano, hostEntity.FirstSeen)
-		if planner.ServerTTL == 0 {
+		if planner.ServerTTL == 0 || hostEntity.Cordoned {
 			continue
 		}
 
-		if (time.Now().Unix() - firstTimeParsed.Unix()) > planner.ServerTTL {
+		if (planner.now().Unix() - firstTimeParsed.Unix()) > planner.ServerTTL {
 			change := PlanningChange{
 				Type:   "retire_server",
 				HostId: hostEntity.Id,
-				Id:     uuid.NewV4().String(),
+				Id:     planner.newId(),
 				Reason: "Server has exceeded the TTL configured, Plan_KullServersExceedingTTL",
 			}
 
@@ -611,12 +1092,12 @@ func (planner *BoringPlanner) Plan_KullServersExceedingTTL(configurationStore co
 func (planner *BoringPlanner) Plan_KullServersInTerminatingState(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	for _, hostEntity := range currentState.GetAllHosts() {
+	for _, hostEntity := range currentState.ListOfAllHosts() {
 		if hostEntity.State == "terminating" {
 			change := PlanningChange{
 				Type:   "kill_server",
 				HostId: hostEntity.Id,
-				Id:     uuid.NewV4().String(),
+				Id:     planner.newId(),
 				Reason: "Server has exceeded the TTL configured, Plan_KullServersInTerminatingState",
 			}
 
@@ -629,12 +1110,12 @@ func (planner *BoringPlanner) Plan_KullServersInTerminatingState(configurationSt
 func (planner *BoringPlanner) Plan_KullServersResourceExceededState(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
 	ret := make([]PlanningChange, 0)
 
-	for _, hostEntity := range currentState.GetAllHosts() {
+	for _, hostEntity := range currentState.ListOfAllHosts() {
 		if hostEntity.State == "resourceExceeded" {
 			change := PlanningChange{
 				Type:   "retire_server",
 				HostId: hostEntity.Id,
-				Id:     uuid.NewV4().String(),
+				Id:     planner.newId(),
 				Reason: "Server has exceeded one of it's resources (most likely HDD), Plan_KullServersResourceExceededState",
 			}
 
@@ -643,7 +1124,7 @@ func (planner *BoringPlanner) Plan_KullServersResourceExceededState(configuratio
 			change := PlanningChange{
 				Type:   "retire_server",
 				HostId: hostEntity.Id,
-				Id:     uuid.NewV4().String(),
+				Id:     planner.newId(),
 				Reason: "Someone from the interface has requested that this instance be terminated",
 			}
 
@@ -666,109 +1147,198 @@ func extend(existing []PlanningChange, changes []PlanningChange) []PlanningChang
 	return ret
 }
 
-func (planner *BoringPlanner) Plan(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
-	ret := make([]PlanningChange, 0)
+type planningStage struct {
+	Name string
 
-	/* First step, deal with servers that are broken ? */
-	ret = extend(ret, planner.Plan_KullBrokenServers(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_KullBrokenServers had events"),
-		})
+	/* Atomic stages have all their changes deferred if any one of them conflicts */
+	Atomic bool
 
-		return ret
-	}
+	/* Told whether the stages changes went out this tick */
+	Settled func(deferred bool)
 
-	/* First step, lets check that our min needs are satisfied? */
-	ret = extend(ret, planner.Plan_SatisfyMinNeeds(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_SatisfyMinNeeds had events"),
-		})
+	Run func(configuration.ConfigurationStore, state.StateStore) []PlanningChange
+}
 
-		return ret
+/* Stages run in priority order, earlier stages win any conflicts */
+func (planner *BoringPlanner) stages() []planningStage {
+	return []planningStage{
+		{Name: "Plan_KullBrokenServers", Run: planner.Plan_KullBrokenServers},
+		{Name: "Plan_Daemons", Run: planner.Plan_Daemons},
+		{Name: "Plan_SatisfyMinNeeds", Run: planner.Plan_SatisfyMinNeeds},
+		{Name: "Plan_RemoveOldVersions", Run: planner.Plan_RemoveOldVersions},
+		{Name: "Plan_RemoveOldDesired", Run: planner.Plan_RemoveOldDesired},
+		{Name: "Plan_SatisfyDesiredNeeds", Run: planner.Plan_SatisfyDesiredNeeds},
+		{Name: "Plan_RunJobs", Run: planner.Plan_RunJobs},
+		{Name: "Plan_KullBrokenApplications", Run: planner.Plan_KullBrokenApplications},
+		{Name: "Plan_DrainHosts", Run: planner.Plan_DrainHosts},
+		{Name: "Plan_KullUnusedServers", Run: planner.Plan_KullUnusedServers},
+		{Name: "Plan_Consolidate", Run: planner.Plan_Consolidate, Atomic: true, Settled: planner.settleConsolidation},
+		{Name: "Plan_KullServersInTerminatingState", Run: planner.Plan_KullServersInTerminatingState},
+		{Name: "Plan_KullServersResourceExceededState", Run: planner.Plan_KullServersResourceExceededState},
+		{Name: "Plan_KullServersExceedingTTL", Run: planner.Plan_KullServersExceedingTTL},
 	}
+}
 
-	/* Ok, now that the mins are running, lets kull of old version of the app */
-	ret = extend(ret, planner.Plan_RemoveOldVersions(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_RemoveOldVersions had events"),
-		})
-
+const PENDING_CLAIM = "pending change"
+
+/* The resources a change touches, killing a server touches every app on it */
+func changeClaims(change PlanningChange, currentState *state.StateStore) []string {
+	switch change.Type {
+	case "add_application", "remove_application":
+		return []string{"app:" + change.ApplicationName, "host:" + change.HostId}
+	case "kill_server", "retire_server":
+		ret := []string{"host:" + change.HostId}
+		hostEntity, err := currentState.GetConfiguration(change.HostId)
+		if err == nil {
+			for _, app := range hostEntity.Apps {
+				ret = append(ret, "app:"+app.Name)
+			}
+		}
 		return ret
+	case "new_server":
+		if change.ApplicationName != "" {
+			return []string{"app:" + change.ApplicationName}
+		}
 	}
+	return []string{}
+}
 
-	/* Ok, now that the min is sorted, lets scale down desired instances */
-	ret = extend(ret, planner.Plan_RemoveOldDesired(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_RemoveOldDesired had events"),
-		})
+/* Changes still in flight block the apps and hosts they touch, and nothing else */
+func (planner *BoringPlanner) pendingClaims(currentState *state.StateStore) (map[string]string, bool) {
+	held := make(map[string]string)
+	blockNewServers := false
 
-		return ret
+	for _, hostEntity := range currentState.ListOfAllHosts() {
+		for _, change := range hostEntity.Changes {
+			held["app:"+change.Name] = PENDING_CLAIM
+			held["host:"+hostEntity.Id] = PENDING_CLAIM
+		}
 	}
 
-	/* Grand, lets scale up the desired */
-	ret = extend(ret, planner.Plan_SatisfyDesiredNeeds(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_SatisfyDesiredNeeds had events"),
-		})
+	for _, change := range planner.ServerChanges {
+		if change.Type == "new_server" {
+			if change.ApplicationName != "" {
+				held["app:"+change.ApplicationName] = PENDING_CLAIM
+			} else {
+				/* We dont know who asked for this server, so hold off on any more until it lands */
+				blockNewServers = true
+			}
+		}
 
-		return ret
+		if change.NewHostId != "" {
+			held["host:"+change.NewHostId] = PENDING_CLAIM
+		}
 	}
 
-	/* Second stage of planning: Terminate any instances that are left behind */
-	ret = extend(ret, planner.Plan_KullBrokenApplications(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_KullBrokenApplications had events"),
-		})
+	return held, blockNewServers
+}
 
-		return ret
-	}
+/* What the cloud provider is still working on, set from the main loop before each Plan */
+func (planner *BoringPlanner) SetServerChanges(changes []*model.ChangeServer, spotUnavailable bool) {
+	planner.planLock.Lock()
+	defer planner.planLock.Unlock()
 
-	ret = extend(ret, planner.Plan_KullUnusedServers(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_KullUnusedServers had events"),
-		})
+	planner.ServerChanges = changes
+	planner.SpotUnavailable = spotUnavailable
+}
 
-		return ret
-	}
+func (planner *BoringPlanner) Plan(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
+	planner.planLock.Lock()
+	defer planner.planLock.Unlock()
 
-	/* Third stage of planning: Move applications around to see if we can optimise it to be cheaper */
-	ret = extend(ret, planner.Plan_OptimiseLayout(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_OptimiseLayout had events"),
-		})
+	ret := make([]PlanningChange, 0)
+	held, blockNewServers := planner.pendingClaims(&currentState)
+	planner.decisions = make([]PlanDecision, 0)
+
+	for _, stage := range planner.stages() {
+		decided := len(planner.decisions)
+		changes := stage.Run(configurationStore, currentState)
+		for i := decided; i < len(planner.decisions); i++ {
+			planner.decisions[i].Stage = stage.Name
+		}
 
-		return ret
-	}
+		if len(changes) == 0 {
+			if stage.Settled != nil {
+				stage.Settled(false)
+			}
+			continue
+		}
 
-	/* Kull servers that are terminating. If we reach this step, MINS/DESIRED are meet so we can kill them of */
-	ret = extend(ret, planner.Plan_KullServersInTerminatingState(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_KullServersInTerminatingState had events"),
-		})
+		accepted := make([]PlanningChange, 0)
+		deferred := false
+		for _, change := range changes {
+			conflict := ""
+			if change.Type == "new_server" && blockNewServers {
+				conflict = "new server " + PENDING_CLAIM
+			}
 
-		return ret
-	}
+			if change.Type == "new_server" && !planner.fleetHasRoom(&currentState, extend(ret, accepted)) {
+				conflict = "fleet is at MaxHostCount"
+			}
 
-	/* Kull servers that have their resources exeeded. If we reach this step, MINS/DESIRED are meet so we can kill them of */
-	ret = extend(ret, planner.Plan_KullServersResourceExceededState(configurationStore, currentState))
-	if len(ret) > 0 {
-		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
-			Message: fmt.Sprintf("Plan_KullServersResourceExceededState had events"),
-		})
+			for _, resource := range changeClaims(change, &currentState) {
+				if owner, ok := held[resource]; ok && owner != stage.Name {
+					conflict = resource + " held by " + owner
+					break
+				}
+			}
 
-		return ret
+			if conflict != "" {
+				planner.decide(PlanDecision{
+					Stage:           stage.Name,
+					ApplicationName: change.ApplicationName,
+					Chosen:          change.HostId,
+					Reason:          fmt.Sprintf("%s deferred, %s", change.Type, conflict),
+				})
+				deferred = true
+
+				/* The host is still wanted, later stages should not kill or empty it in the meantime */
+				if change.Type == "add_application" {
+					if _, ok := held["host:"+change.HostId]; !ok {
+						held["host:"+change.HostId] = stage.Name
+					}
+				}
+				continue
+			}
+
+			accepted = append(accepted, change)
+		}
+
+		/* Stages without their own decision records are explained by the changes they made */
+		if len(planner.decisions) == decided {
+			for _, change := range accepted {
+				planner.decide(PlanDecision{
+					Stage:           stage.Name,
+					ApplicationName: change.ApplicationName,
+					Chosen:          change.HostId,
+					Reason:          strings.TrimSpace(change.Type + " " + change.Reason),
+				})
+			}
+		}
+
+		if stage.Settled != nil {
+			stage.Settled(stage.Atomic && deferred)
+		}
+
+		if stage.Atomic && deferred {
+			continue
+		}
+
+		for _, change := range accepted {
+			for _, resource := range changeClaims(change, &currentState) {
+				held[resource] = stage.Name
+			}
+		}
+
+		if len(accepted) > 0 {
+			planner.audit(state.AuditEvent{Severity: state.AUDIT__INFO,
+				Message: fmt.Sprintf("%s had events", stage.Name),
+			})
+
+			ret = extend(ret, accepted)
+		}
 	}
 
-	/* Last stage of planning: Kill servers that are older than 24hours or configured TTL */
-	ret = extend(ret, planner.Plan_KullServersExceedingTTL(configurationStore, currentState))
+	planner.record(ret)
 	return ret
 }
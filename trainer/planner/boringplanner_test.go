@@ -19,12 +19,15 @@ along with Orca.  If not, see <http://www.gnu.org/licenses/>.
 package planner
 
 import (
+	"encoding/json"
 	"fmt"
 	"orca/trainer/configuration"
 	"orca/trainer/model"
 	"orca/trainer/schedule"
 	"orca/trainer/state"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPlan_spawnMinHosts(t *testing.T) {
@@ -367,7 +370,7 @@ func TestPlan_spawnMinHosts__DontUseSpotInstance(t *testing.T) {
 
 	stateStore.Add("host1", host1)
 
-	res := planner.Plan(config, stateStore)
+	res := appChanges(planner.Plan(config, stateStore), "app1")
 	if len(res) != 1 || res[0].Type != "new_server" || res[0].Network == "" {
 		t.Errorf("%+v", res)
 	}
@@ -826,12 +829,143 @@ func TestPlan_scaleUp_UsingAffinity(t *testing.T) {
 	}
 	stateStore.Add("host2", host2)
 
-	res := planner.Plan(config, stateStore)
+	res := appChanges(planner.Plan(config, stateStore), "app1")
 	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host2" {
 		t.Errorf("%+v", res)
 	}
 }
 
+func TestPlan_scaleUp_UsingPlacementLabels(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Placement: model.Placement{
+			Required: []model.LabelSelector{
+				{Key: "zone", Operator: model.LABEL__IN, Values: []string{"a", "b"}},
+				{Key: "pool", Operator: model.LABEL__NOT_IN, Values: []string{"batch"}},
+			},
+			Preferred: []model.PreferredLabelSelector{
+				{Weight: 10, Selector: model.LabelSelector{Key: "disk", Operator: model.LABEL__EQUALS, Values: []string{"ssd"}}},
+			},
+		},
+	}
+	config.Add("app1", &model.ApplicationConfiguration{
+		Name:               "app1",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+
+	/* Wrong zone */
+	stateStore.Add("host1", &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Labels:         map[string]string{"zone": "c", "disk": "ssd"},
+		Apps:           []model.Application{},
+	})
+
+	/* Excluded pool */
+	stateStore.Add("host2", &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Labels:         map[string]string{"zone": "a", "pool": "batch", "disk": "ssd"},
+		Apps:           []model.Application{},
+	})
+
+	/* Allowed, but not preferred */
+	stateStore.Add("host3", &model.Host{
+		Id:             "host3",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Labels:         map[string]string{"zone": "b"},
+		Apps:           []model.Application{},
+	})
+
+	/* Allowed and preferred */
+	stateStore.Add("host4", &model.Host{
+		Id:             "host4",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Labels:         map[string]string{"zone": "a", "disk": "ssd"},
+		Apps:           []model.Application{},
+	})
+
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host4" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_spawnMinHosts_WithPlacementLabels(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Placement: model.Placement{
+			Required: []model.LabelSelector{
+				{Key: "zone", Operator: model.LABEL__EQUALS, Values: []string{"a"}},
+				{Key: "gpu", Operator: model.LABEL__EXISTS},
+			},
+		},
+	}
+	config.Add("app1", &model.ApplicationConfiguration{
+		Name:               "app1",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+
+	stateStore.Add("host1", &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Labels:         map[string]string{"zone": "a"},
+		Apps:           []model.Application{},
+	})
+
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "new_server" {
+		t.Errorf("%+v", res)
+		return
+	}
+
+	if res[0].Labels["zone"] != "a" || res[0].Labels["gpu"] != "true" {
+		t.Errorf("%+v", res[0].Labels)
+	}
+}
+
 func TestPlan_scaleUp_HitCapacity(t *testing.T) {
 	planner := BoringPlanner{}
 
@@ -894,37 +1028,187 @@ func TestPlan_scaleUp_HitCapacity(t *testing.T) {
 	}
 	stateStore.Add("host2", host2)
 
-	res := planner.Plan(config, stateStore)
+	res := appChanges(planner.Plan(config, stateStore), "app3")
 	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host2" {
 		t.Errorf("%+v", res)
 	}
 }
 
-func TestPlan__Plan_RemoveOldDesired(t *testing.T) {
-	planner := BoringPlanner{}
+/*
+	Shared setup for the scenario tests below. Apps and hosts all sit in network1 and secgrp1,
+	so only what a test changes decides where things go.
+*/
+func testStores(settings configuration.GlobalSettings) (*BoringPlanner, configuration.ConfigurationStore, state.StateStore) {
+	planner := &BoringPlanner{}
 
 	config := configuration.ConfigurationStore{}
 	config.Init("")
+	config.GlobalSettings = settings
+	planner.Init(config.GlobalSettings)
+
 	stateStore := state.StateStore{}
 	stateStore.Init(&config)
+	return planner, config, stateStore
+}
+
+func defaultSettings() configuration.GlobalSettings {
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	return config.GlobalSettings
+}
+
+/* Publishes version 1 of the app unless it brings its own versions */
+func addTestApp(config configuration.ConfigurationStore, app *model.ApplicationConfiguration) *model.ApplicationConfiguration {
+	if app.PublishedConfig == nil {
+		app.PublishedConfig = make(map[string]*model.VersionConfig)
+		app.PublishedConfig["1"] = &model.VersionConfig{
+			Version:        "1",
+			Network:        "network1",
+			SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		}
+	}
+	app.Enabled = true
+	return config.Add(app.Name, app)
+}
+
+/* A running host with version 1 of each app running on it */
+func addTestHost(stateStore state.StateStore, id string, apps ...string) *model.Host {
+	host := &model.Host{
+		Id:             id,
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+		FirstSeen:      time.Now().Format(time.RFC3339Nano),
+	}
+	for _, app := range apps {
+		host.Apps = append(host.Apps, model.Application{Name: app, Version: "1", State: "running"})
+	}
+	stateStore.Add(id, host)
+	return host
+}
+
+func TestPlan_PreemptLowerPriorityAtFleetLimit(t *testing.T) {
+	settings := defaultSettings()
+	settings.ServerCapacity = 2
+	settings.MaxHostCount = 1
+	planner, config, stateStore := testStores(settings)
+	addTestApp(config, &model.ApplicationConfiguration{Name: "batch", MinDeployment: 1, DesiredDeployment: 1})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "reports", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "web", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestHost(stateStore, "host1", "batch", "reports")
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 2 {
+		t.Fatalf("%+v", res)
+	}
+
+	if res[0].Type != "remove_application" || res[0].ApplicationName != "batch" || res[0].HostId != "host1" || res[0].Reason == "" {
+		t.Errorf("%+v", res[0])
+	}
+
+	if res[1].Type != "add_application" || res[1].ApplicationName != "web" || res[1].HostId != "host1" {
+		t.Errorf("%+v", res[1])
+	}
 
+	/* Once there is room again the evicted app gets a new server */
+	stateStore.GetAllHosts()["host1"].Apps = []model.Application{{Name: "web", Version: "1", State: "running"}, {Name: "reports", Version: "1", State: "running"}}
+	config.GlobalSettings.MaxHostCount = 2
 	planner.Init(config.GlobalSettings)
-	//state.Audit.Init(&config)
 
+	res = planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "new_server" || res[0].ApplicationName != "batch" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_NoPreemptionOfEqualPriority(t *testing.T) {
+	settings := defaultSettings()
+	settings.ServerCapacity = 2
+	settings.MaxHostCount = 1
+	planner, config, stateStore := testStores(settings)
+	addTestApp(config, &model.ApplicationConfiguration{Name: "batch", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "reports", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "web", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestHost(stateStore, "host1", "batch", "reports")
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 0 {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_HigherPriorityPlacedFirst(t *testing.T) {
+	settings := defaultSettings()
+	settings.ServerCapacity = 2
+	settings.MaxHostCount = 1
+	planner, config, stateStore := testStores(settings)
+	addTestApp(config, &model.ApplicationConfiguration{Name: "batch", MinDeployment: 1, DesiredDeployment: 1})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "reports", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "web", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestHost(stateStore, "host1", "reports")
+
+	/* batch comes first by name, but web gets the last slot */
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].ApplicationName != "web" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_ExplainRejectedHosts(t *testing.T) {
+	settings := defaultSettings()
+	settings.ServerCapacity = 2
+	settings.MaxHostCount = 1
+	planner, config, stateStore := testStores(settings)
+	addTestApp(config, &model.ApplicationConfiguration{Name: "batch", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "reports", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "web", MinDeployment: 1, DesiredDeployment: 1, Priority: 5})
+	addTestHost(stateStore, "host1", "batch", "reports")
+	addTestHost(stateStore, "host2").Network = "network2"
+
+	planner.Plan(config, stateStore)
+	decisions := planner.Explain("web")
+	if len(decisions) != 1 || decisions[0].Stage != "Plan_SatisfyMinNeeds" || decisions[0].Chosen != "" || len(decisions[0].Considered) != 2 {
+		t.Fatalf("%+v", decisions)
+	}
+
+	for _, considered := range decisions[0].Considered {
+		if considered.HostId == "host1" && considered.Rejected != "host is at capacity" {
+			t.Errorf("%+v", considered)
+		}
+		if considered.HostId == "host2" && considered.Rejected != "network network2 does not match network1" {
+			t.Errorf("%+v", considered)
+		}
+	}
+
+	if len(planner.History()) != 1 {
+		t.Errorf("%+v", planner.History())
+	}
+}
+
+func TestPlan_scaleUp_SpreadPerNetwork(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
 	versionConfigApp1 := make(map[string]*model.VersionConfig)
 	versionConfigApp1["1"] = &model.VersionConfig{
 		Version:        "1",
 		Network:        "network1",
-		SecurityGroups: make([]model.SecurityGroup, 0),
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
 	}
-
 	config.Add("app1", &model.ApplicationConfiguration{
 		Name:               "app1",
 		MinDeployment:      1,
-		DesiredDeployment:  1,
+		DesiredDeployment:  3,
 		DeploymentSchedule: schedule.DeploymentSchedule{},
 		PublishedConfig:    versionConfigApp1,
 		Enabled:            true,
+		Spread:             model.SpreadConstraints{MaxPerNetwork: 2},
 	})
 
 	host1 := &model.Host{
@@ -932,14 +1216,14 @@ func TestPlan__Plan_RemoveOldDesired(t *testing.T) {
 		Network:        "network1",
 		State:          "running",
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}, {Name: "app2", Version: "1", State: "running"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
 	}
 	stateStore.Add("host1", host1)
 
 	host2 := &model.Host{
 		Id:             "host2",
-		Network:        "network1",
 		State:          "running",
+		Network:        "network1",
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
 		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
 	}
@@ -947,73 +1231,83 @@ func TestPlan__Plan_RemoveOldDesired(t *testing.T) {
 
 	host3 := &model.Host{
 		Id:             "host3",
-		Network:        "network1",
 		State:          "running",
+		Network:        "network1",
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
+		Apps:           []model.Application{},
 	}
 	stateStore.Add("host3", host3)
 
-	changes := planner.Plan_RemoveOldDesired(config, stateStore)
-	if len(changes) != 1 || changes[0].Type != "remove_application" && changes[0].HostId != "host2" {
-		t.Errorf("%+v", changes)
+	/* network1 is full for app1, neither host3 nor a new server in network1 may be used */
+	res := planner.Plan(config, stateStore)
+	for _, change := range res {
+		if change.Type == "add_application" || change.Type == "new_server" {
+			t.Errorf("%+v", res)
+		}
 	}
 }
 
-func TestPlan__Plan_KullUnusedServers(t *testing.T) {
-	planner := BoringPlanner{}
+func TestPlan_SpreadPerHost(t *testing.T) {
+	settings := defaultSettings()
+	settings.MaxInstancesPerHost = 1
+	planner, config, stateStore := testStores(settings)
 
-	config := configuration.ConfigurationStore{}
-	config.Init("")
-	planner.Init(config.GlobalSettings)
-	stateStore := state.StateStore{}
-	stateStore.Init(&config)
-	//state.Audit.Init(&config)
+	app := addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 2})
+	host1 := addTestHost(stateStore, "host1", "app1")
+	host2 := addTestHost(stateStore, "host2")
 
-	host1 := &model.Host{
-		Id:             "host1",
-		Network:        "network1",
-		State:          "running",
-		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}, {Name: "app2", Version: "1", State: "running"}},
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].HostId != "host2" {
+		t.Errorf("%+v", res)
 	}
-	stateStore.Add("host1", host1)
 
-	host2 := &model.Host{
-		Id:             "host2",
-		Network:        "network1",
-		State:          "running",
-		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
+	/* The global limit counts adds planned this round, the apps own limit replaces it */
+	planned := []PlanningChange{{Type: "add_application", HostId: "host2", ApplicationName: "app1"}}
+	if planner.hostSatisfiesSpread(host1, app, &stateStore, nil, "") || planner.hostSatisfiesSpread(host2, app, &stateStore, planned, "") {
+		t.Error("the global per host limit was ignored")
 	}
-	stateStore.Add("host2", host2)
 
-	host3 := &model.Host{
-		Id:             "host3",
-		Network:        "network1",
-		State:          "running",
-		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{},
+	app.Spread.MaxPerHost = 2
+	if !planner.hostSatisfiesSpread(host2, app, &stateStore, planned, "") {
+		t.Error("the apps per host limit did not replace the global one")
 	}
-	stateStore.Add("host3", host3)
+}
 
-	host4 := &model.Host{
-		Id:             "host4",
-		Network:        "network1",
-		State:          "initialising",
-		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{},
+func TestPlan_scaleUp_SpreadPerTopology(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+
+	app := addTestApp(config, &model.ApplicationConfiguration{
+		Name:              "app1",
+		MinDeployment:     1,
+		DesiredDeployment: 2,
+		Spread:            model.SpreadConstraints{TopologyKey: "zone", MaxPerTopology: 1},
+	})
+	app.PublishedConfig["1"].Placement = model.Placement{
+		Required: []model.LabelSelector{{Key: "tier", Operator: model.LABEL__EQUALS, Values: []string{"web"}}},
 	}
-	stateStore.Add("host4", host4)
 
-	changes := planner.Plan_KullUnusedServers(config, stateStore)
-	if len(changes) != 1 || changes[0].Type != "kill_server" && changes[0].HostId != "host3" {
-		t.Errorf("%+v", changes)
+	/* The grouping tag is ignored once the app has a placement, the zone label still spreads it */
+	addTestHost(stateStore, "host1", "app1").Labels = map[string]string{"tier": "web", "zone": "a"}
+	host2 := addTestHost(stateStore, "host2")
+	host2.Labels = map[string]string{"tier": "web", "zone": "a"}
+	host2.GroupingTag = "other"
+	addTestHost(stateStore, "host3").Labels = map[string]string{"tier": "web", "zone": "b"}
+
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host3" {
+		t.Errorf("%+v", res)
 	}
 
+	/* Consolidation may not move the zone b copy into zone a either */
+	host3, _ := stateStore.GetConfiguration("host3")
+	host3.Apps = []model.Application{{Name: "app1", Version: "1", State: "running"}}
+	host1, _ := stateStore.GetConfiguration("host1")
+	if planner.canReceive(host2, host3, app, config, &stateStore, nil) || !planner.canReceive(host2, host1, app, config, &stateStore, nil) {
+		t.Error("consolidation ignored the topology spread")
+	}
 }
 
-func TestPlan__Plan_BasicOptimise(t *testing.T) {
+func TestPlan_scaleUp_AntiAffinity(t *testing.T) {
 	planner := BoringPlanner{}
 
 	config := configuration.ConfigurationStore{}
@@ -1022,15 +1316,12 @@ func TestPlan__Plan_BasicOptimise(t *testing.T) {
 
 	stateStore := state.StateStore{}
 	stateStore.Init(&config)
-	//state.Audit.Init(&config)
-
 	versionConfigApp1 := make(map[string]*model.VersionConfig)
 	versionConfigApp1["1"] = &model.VersionConfig{
 		Version:        "1",
 		Network:        "network1",
-		SecurityGroups: make([]model.SecurityGroup, 0),
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
 	}
-
 	config.Add("app1", &model.ApplicationConfiguration{
 		Name:               "app1",
 		MinDeployment:      1,
@@ -1039,21 +1330,22 @@ func TestPlan__Plan_BasicOptimise(t *testing.T) {
 		PublishedConfig:    versionConfigApp1,
 		Enabled:            true,
 	})
+
+	/* Only app2 names app1, the rule still applies when placing app1 */
+	versionConfigApp2 := make(map[string]*model.VersionConfig)
+	versionConfigApp2["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+	}
 	config.Add("app2", &model.ApplicationConfiguration{
 		Name:               "app2",
 		MinDeployment:      1,
 		DesiredDeployment:  1,
 		DeploymentSchedule: schedule.DeploymentSchedule{},
-		PublishedConfig:    versionConfigApp1,
-		Enabled:            true,
-	})
-	config.Add("app3", &model.ApplicationConfiguration{
-		Name:               "app3",
-		MinDeployment:      1,
-		DesiredDeployment:  1,
-		DeploymentSchedule: schedule.DeploymentSchedule{},
-		PublishedConfig:    versionConfigApp1,
+		PublishedConfig:    versionConfigApp2,
 		Enabled:            true,
+		AntiAffinity:       []model.AntiAffinity{{Name: "app1"}},
 	})
 
 	host1 := &model.Host{
@@ -1061,40 +1353,697 @@ func TestPlan__Plan_BasicOptimise(t *testing.T) {
 		Network:        "network1",
 		State:          "running",
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}, {Name: "app2", Version: "1", State: "running"}},
+		Apps:           []model.Application{{Name: "app2", Version: "1", State: "running"}},
 	}
 	stateStore.Add("host1", host1)
 
 	host2 := &model.Host{
 		Id:             "host2",
-		Network:        "network1",
 		State:          "running",
-		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "app3", Version: "1", State: "running"}},
-	}
-	stateStore.Add("host2", host2)
-
-	host3 := &model.Host{
-		Id:             "host4",
 		Network:        "network1",
-		State:          "initialising",
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
 		Apps:           []model.Application{},
 	}
-	stateStore.Add("host3", host3)
+	stateStore.Add("host2", host2)
 
-	changes := planner.Plan_OptimiseLayout(config, stateStore)
-	//fmt.Println("%+v", changes)
-	fmt.Printf("changes: %+v", changes)
-	if len(changes) != 2 || changes[0].Type != "add_application" && changes[0].HostId != "host1" {
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host2" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_CordonedHostGetsNoApps(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1})
+	addTestHost(stateStore, "host1").Cordoned = true
+	addTestHost(stateStore, "host2", "app1")
+
+	/* The empty cordoned host is neither used nor killed */
+	res := planner.Plan(config, stateStore)
+	if len(res) != 0 {
+		t.Errorf("%+v", res)
+	}
+
+	stateStore.GetAllHosts()["host2"].Cordoned = true
+	stateStore.GetAllHosts()["host2"].Apps = []model.Application{}
+	res = planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "new_server" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_DrainHost(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1})
+	host1 := addTestHost(stateStore, "host1", "app1")
+	host1.Cordoned = true
+	host1.Draining = true
+	addTestHost(stateStore, "host2").Apps = []model.Application{{Name: "app1", Version: "1", State: "failed"}}
+
+	/* The replacement goes in first */
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host2" {
+		t.Errorf("%+v", res)
+	}
+
+	stateStore.GetAllHosts()["host2"].Apps = []model.Application{{Name: "app1", Version: "1", State: "running"}}
+	res = planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "remove_application" || res[0].HostId != "host1" || res[0].Reason == "" {
+		t.Errorf("%+v", res)
+	}
+
+	/* The drained host stays up */
+	stateStore.GetAllHosts()["host1"].Apps = []model.Application{}
+	res = planner.Plan(config, stateStore)
+	if len(res) != 0 {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_SpotPolicyNever(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 2, SpotPolicy: model.SpotPolicy{Mode: model.SPOT__NEVER}})
+	addTestHost(stateStore, "reliable1", "app1")
+	addTestHost(stateStore, "reliable2")
+	addTestHost(stateStore, "spot1").SpotInstance = true
+
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "reliable2" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_SpotPolicyOnlyWithReliabilityFloor(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1, SpotPolicy: model.SpotPolicy{Mode: model.SPOT__ONLY}})
+	addTestHost(stateStore, "reliable1")
+	addTestHost(stateStore, "spot1").SpotInstance = true
+
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "spot1" {
+		t.Errorf("%+v", res)
+	}
+
+	/* New servers for spot only apps never fall back to reliable instances */
+	stateStore.GetAllHosts()["spot1"].Cordoned = true
+	res = appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "new_server" || !res[0].RequiresSpotInstance || res[0].RequiresReliableInstance {
+		t.Errorf("%+v", res)
+	}
+
+	planner.SpotUnavailable = true
+	for _, change := range planner.Plan(config, stateStore) {
+		if change.ApplicationName == "app1" {
+			t.Errorf("%+v", change)
+		}
+	}
+
+	app, _ := config.GetConfiguration("app1")
+	app.SpotPolicy.ReliabilityFloor = 1
+	res = planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "reliable1" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_PreemptForSpotOnlyMinWhenSpotUnavailable(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	planner.ServerCapacity = 1
+	planner.SpotUnavailable = true
+
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1, Priority: 10, SpotPolicy: model.SpotPolicy{Mode: model.SPOT__ONLY}})
+	addTestApp(config, &model.ApplicationConfiguration{Name: "batch", MinDeployment: 1, DesiredDeployment: 1})
+	addTestHost(stateStore, "spot1", "batch").SpotInstance = true
+
+	/* batch wants its own reliable server as well, only the swap matters here */
+	res := planner.Plan(config, stateStore)
+	if len(res) < 2 || res[0].Type != "remove_application" || res[0].ApplicationName != "batch" || res[0].HostId != "spot1" {
+		t.Fatalf("%+v", res)
+	}
+
+	if res[1].Type != "add_application" || res[1].ApplicationName != "app1" || res[1].HostId != "spot1" {
+		t.Errorf("%+v", res[1])
+	}
+}
+
+func TestPlan_SpotPolicyPercentage(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 4, SpotPolicy: model.SpotPolicy{Mode: model.SPOT__PERCENTAGE, Percentage: 50}})
+	addTestHost(stateStore, "reliable1", "app1")
+	addTestHost(stateStore, "reliable2")
+	addTestHost(stateStore, "spot1", "app1").SpotInstance = true
+	addTestHost(stateStore, "spot2").SpotInstance = true
+
+	/* Half of the four replicas have to be reliable */
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].HostId != "reliable2" {
+		t.Errorf("%+v", res)
+	}
+
+	stateStore.GetAllHosts()["reliable2"].Apps = []model.Application{{Name: "app1", Version: "1", State: "running"}}
+	res = planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].HostId != "spot2" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func appChanges(changes []PlanningChange, name string) []PlanningChange {
+	ret := make([]PlanningChange, 0)
+	for _, change := range changes {
+		if change.ApplicationName == name {
+			ret = append(ret, change)
+		}
+	}
+	return ret
+}
+
+func TestPlan_MaxDeploymentCapsDesired(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 500, MaxDeployment: 2})
+	addTestHost(stateStore, "reliable1", "app1")
+	addTestHost(stateStore, "reliable2")
+	addTestHost(stateStore, "spot1").SpotInstance = true
+	addTestHost(stateStore, "spot2").SpotInstance = true
+
+	res := appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" {
+		t.Errorf("%+v", res)
+	}
+
+	/* At the max nothing more is added, above it the extra replica goes. Empty hosts are killed, which we ignore here */
+	stateStore.GetAllHosts()["reliable2"].Apps = []model.Application{{Name: "app1", Version: "1", State: "running"}}
+	res = appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 0 {
+		t.Errorf("%+v", res)
+	}
+
+	stateStore.GetAllHosts()["spot1"].Apps = []model.Application{{Name: "app1", Version: "1", State: "running"}}
+	res = appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "remove_application" || res[0].HostId != "spot1" {
+		t.Errorf("%+v", res)
+	}
+}
+
+/* What main does with the planned add_application, and the host picking it up */
+func startJobRuns(stateStore state.StateStore, changes []PlanningChange) {
+	for _, change := range changes {
+		if change.Type == "add_application" && change.JobId != "" {
+			stateStore.AddJobRun(change.JobId, change.HostId, change.Id, time.Now())
+			stateStore.GetAllHosts()[change.HostId].Apps = []model.Application{{Name: change.ApplicationName, Version: "1", State: "running"}}
+		}
+	}
+}
+
+func exitJobRun(stateStore state.StateStore, hostId string, code int) {
+	stateStore.HostCheckin(hostId, model.HostCheckinDataPackage{
+		State: []model.ApplicationStateFromHost{{Name: "job1", Application: model.Application{Name: "job1", Version: "1", State: "exited", ExitCode: code}}},
+	})
+}
+
+func TestPlan_JobRunsToCompletion(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	app := addTestApp(config, &model.ApplicationConfiguration{
+		Name: "job1",
+		Type: model.APPLICATION__JOB,
+		Job:  model.JobSpec{Completions: 3, Parallelism: 2, RetryLimit: 1},
+	})
+	addTestHost(stateStore, "host1")
+	addTestHost(stateStore, "host2")
+	addTestHost(stateStore, "host3")
+	job := stateStore.StartJob(app, "job-1", time.Now())
+
+	res := appChanges(planner.Plan(config, stateStore), "job1")
+	if len(res) != 2 || res[0].JobId != "job-1" || res[1].JobId != "job-1" || res[0].HostId == res[1].HostId {
+		t.Fatalf("%+v", res)
+	}
+	startJobRuns(stateStore, res)
+
+	/* At parallelism, nothing more until a run finishes */
+	if res := appChanges(planner.Plan(config, stateStore), "job1"); len(res) != 0 {
+		t.Errorf("%+v", res)
+	}
+
+	exitJobRun(stateStore, res[0].HostId, 0)
+	if _, succeeded, _ := job.Counts(); succeeded != 1 {
+		t.Errorf("%+v", job.Runs)
+	}
+
+	/* The finished run is cleaned up and the last completion goes on the free host */
+	next := appChanges(planner.Plan(config, stateStore), "job1")
+	if len(next) != 2 || next[0].Type != "remove_application" || next[0].HostId != res[0].HostId || next[1].Type != "add_application" || next[1].HostId != "host3" {
+		t.Fatalf("%+v", next)
+	}
+	startJobRuns(stateStore, next[1:])
+
+	exitJobRun(stateStore, res[1].HostId, 0)
+	exitJobRun(stateStore, "host3", 0)
+	if job.State != state.JOB__SUCCEEDED {
+		t.Errorf("%s %+v", job.State, job.Runs)
+	}
+}
+
+func TestPlan_JobRetryLimit(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	app := addTestApp(config, &model.ApplicationConfiguration{
+		Name: "job1",
+		Type: model.APPLICATION__JOB,
+		Job:  model.JobSpec{Completions: 3, Parallelism: 2, RetryLimit: 1},
+	})
+	addTestHost(stateStore, "host1")
+	addTestHost(stateStore, "host2")
+	addTestHost(stateStore, "host3")
+	job := stateStore.StartJob(app, "job-1", time.Now())
+
+	res := appChanges(planner.Plan(config, stateStore), "job1")
+	startJobRuns(stateStore, res)
+
+	exitJobRun(stateStore, res[0].HostId, 1)
+	if job.State != state.JOB__RUNNING || job.Runs[0].ExitCode != 1 {
+		t.Errorf("%s %+v", job.State, job.Runs[0])
+	}
+
+	exitJobRun(stateStore, res[1].HostId, 2)
+	if job.State != state.JOB__FAILED {
+		t.Errorf("%s", job.State)
+	}
+
+	/* A failed job starts no more runs, only cleans up */
+	for _, change := range appChanges(planner.Plan(config, stateStore), "job1") {
+		if change.Type != "remove_application" {
+			t.Errorf("%+v", change)
+		}
+	}
+}
+
+func TestPlan_DaemonOnEveryMatchingHost(t *testing.T) {
+	planner := &BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+	planner.ServerCapacity = 1
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	for _, name := range []string{"agent1", "app1"} {
+		versionConfig := make(map[string]*model.VersionConfig)
+		versionConfig["1"] = &model.VersionConfig{
+			Version:        "1",
+			Network:        "network1",
+			SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		}
+		config.Add(name, &model.ApplicationConfiguration{
+			Name:              name,
+			MinDeployment:     1,
+			DesiredDeployment: 1,
+			PublishedConfig:   versionConfig,
+			Enabled:           true,
+		})
+	}
+	agent, _ := config.GetConfiguration("agent1")
+	agent.Type = model.APPLICATION__DAEMON
+
+	addHost := func(id string, network string, apps []model.Application) *model.Host {
+		host := &model.Host{
+			Id:             id,
+			Network:        network,
+			State:          "running",
+			SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+			Apps:           apps,
+			FirstSeen:      time.Now().Format(time.RFC3339Nano),
+		}
+		stateStore.Add(id, host)
+		return host
+	}
+	addHost("host1", "network1", []model.Application{{Name: "agent1", Version: "1", State: "running"}})
+	addHost("host2", "network1", []model.Application{})
+	addHost("host3", "network2", []model.Application{{Name: "agent1", Version: "1", State: "running"}})
+	addHost("host4", "network1", []model.Application{{Name: "agent1", Version: "1", State: "running"}}).Cordoned = true
+
+	/* The daemon goes on the new host, comes off the host in the wrong network, and leaves the cordoned host alone */
+	res := appChanges(planner.Plan(config, stateStore), "agent1")
+	changed := make(map[string]string)
+	for _, change := range res {
+		changed[change.HostId] = change.Type
+	}
+	if len(res) != 2 || changed["host2"] != "add_application" || changed["host3"] != "remove_application" {
+		t.Fatalf("%+v", res)
+	}
+
+	/* Both the add and the remove are explained */
+	history := planner.History()
+	explained := make(map[string]string)
+	for _, decision := range history[len(history)-1].Decisions {
+		if decision.Stage == "Plan_Daemons" {
+			explained[decision.Chosen] = decision.Reason
+		}
+	}
+	if len(explained) != 2 || !strings.Contains(explained["host3"], "no longer matches") {
+		t.Errorf("%+v", explained)
+	}
+
+	/* The daemon takes none of host1's capacity of one */
+	res = appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host1" {
+		t.Errorf("%+v", res)
+	}
+
+	/* A host with only daemons on it is unused */
+	stateStore.GetAllHosts()["host1"].Apps = append(stateStore.GetAllHosts()["host1"].Apps, model.Application{Name: "app1", Version: "1", State: "running"})
+	stateStore.GetAllHosts()["host2"].Apps = []model.Application{{Name: "agent1", Version: "1", State: "running"}}
+	stateStore.GetAllHosts()["host3"].Apps = []model.Application{}
+	killed := make(map[string]bool)
+	for _, change := range planner.Plan(config, stateStore) {
+		if change.Type == "kill_server" {
+			killed[change.HostId] = true
+		}
+	}
+	if len(killed) != 2 || !killed["host2"] || !killed["host3"] {
+		t.Errorf("%+v", killed)
+	}
+}
+
+func TestPlan_CatalogPicksCheapestFittingType(t *testing.T) {
+	settings := defaultSettings()
+	settings.CloudProvider = "aws"
+	settings.InstanceType = "t2.micro"
+	settings.InstanceCatalog = []configuration.InstanceCatalogEntry{
+		{Name: "large", Cpu: 4, Memory: 16000, Price: 0.4, SpotEligible: true},
+		{Name: "small", Cpu: 1, Memory: 2000, Price: 0.05},
+		{Name: "medium", Cpu: 2, Memory: 8000, Price: 0.1, SpotEligible: true},
+		{Name: "cheap-elsewhere", Cpu: 8, Memory: 32000, Price: 0.01, Provider: "gcp"},
+	}
+
+	/* small is cheapest for a tiny app, and as it cannot run spot the server must be reliable. Too big for the catalog falls back to the default type */
+	for _, expected := range []struct {
+		needs        model.AppNeeds
+		instanceType string
+		reason       string
+		reliable     bool /* Only checked when set */
+	}{
+		{model.AppNeeds{CpuNeeds: 1.5, MemoryNeeds: 4000}, "medium", "INSTANCE CATALOG: Picked medium", false},
+		{model.AppNeeds{CpuNeeds: 0.5, MemoryNeeds: 1000}, "small", "INSTANCE CATALOG: Picked small", true},
+		{model.AppNeeds{CpuNeeds: 6, MemoryNeeds: 1000}, "", "INSTANCE CATALOG: No instance type fits", false},
+	} {
+		planner, config, stateStore := testStores(settings)
+		addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1}).PublishedConfig["1"].Needs = expected.needs
+
+		res := planner.Plan(config, stateStore)
+		if len(res) != 1 || res[0].Type != "new_server" || res[0].InstanceType != expected.instanceType || !strings.HasPrefix(res[0].Reason, expected.reason) || (expected.reliable && !res[0].RequiresReliableInstance) {
+			t.Errorf("%+v", res)
+		}
+	}
+}
+
+func TestPlan_CatalogRespectsSpotEligibility(t *testing.T) {
+	settings := defaultSettings()
+	settings.CloudProvider = "aws"
+	settings.InstanceType = "t2.micro"
+	settings.InstanceCatalog = []configuration.InstanceCatalogEntry{
+		{Name: "large", Cpu: 4, Memory: 16000, Price: 0.4, SpotEligible: true},
+		{Name: "small", Cpu: 1, Memory: 2000, Price: 0.05},
+		{Name: "medium", Cpu: 2, Memory: 8000, Price: 0.1, SpotEligible: true},
+		{Name: "cheap-elsewhere", Cpu: 8, Memory: 32000, Price: 0.01, Provider: "gcp"},
+	}
+	planner, config, stateStore := testStores(settings)
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1, SpotPolicy: model.SpotPolicy{Mode: model.SPOT__ONLY}}).PublishedConfig["1"].Needs = model.AppNeeds{CpuNeeds: 0.5, MemoryNeeds: 1000}
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || !res[0].RequiresSpotInstance || res[0].InstanceType != "medium" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_CatalogHostAcceptsApps(t *testing.T) {
+	settings := defaultSettings()
+	settings.CloudProvider = "aws"
+	settings.InstanceType = "t2.micro"
+	settings.InstanceCatalog = []configuration.InstanceCatalogEntry{
+		{Name: "large", Cpu: 4, Memory: 16000, Price: 0.4, SpotEligible: true},
+		{Name: "small", Cpu: 1, Memory: 2000, Price: 0.05},
+		{Name: "medium", Cpu: 2, Memory: 8000, Price: 0.1, SpotEligible: true},
+		{Name: "cheap-elsewhere", Cpu: 8, Memory: 32000, Price: 0.01, Provider: "gcp"},
+	}
+	planner, config, stateStore := testStores(settings)
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 1}).PublishedConfig["1"].Needs = model.AppNeeds{CpuNeeds: 1.5, MemoryNeeds: 4000}
+	addTestHost(stateStore, "reliable1").InstanceType = "medium"
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "reliable1" {
+		t.Errorf("%+v", res)
+	}
+
+	/* A catalog type too small for the app is not correct for it */
+	stateStore.GetAllHosts()["reliable1"].InstanceType = "small"
+	res = appChanges(planner.Plan(config, stateStore), "app1")
+	if len(res) != 1 || res[0].Type != "new_server" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan__Plan_RemoveOldDesired(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	planner.Init(config.GlobalSettings)
+	//state.Audit.Init(&config)
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: make([]model.SecurityGroup, 0),
+	}
+
+	config.Add("app1", &model.ApplicationConfiguration{
+		Name:               "app1",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+
+	host1 := &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}, {Name: "app2", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host1", host1)
+
+	host2 := &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host2", host2)
+
+	host3 := &model.Host{
+		Id:             "host3",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host3", host3)
+
+	changes := planner.Plan_RemoveOldDesired(config, stateStore)
+	if len(changes) != 1 || changes[0].Type != "remove_application" && changes[0].HostId != "host2" {
 		t.Errorf("%+v", changes)
 	}
-	if len(changes) != 2 || changes[1].Type != "remove_application" && changes[1].HostId != "host2" {
+}
+
+func TestPlan__Plan_KullUnusedServers(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+	//state.Audit.Init(&config)
+
+	host1 := &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}, {Name: "app2", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host1", host1)
+
+	host2 := &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host2", host2)
+
+	host3 := &model.Host{
+		Id:             "host3",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+	}
+	stateStore.Add("host3", host3)
+
+	host4 := &model.Host{
+		Id:             "host4",
+		Network:        "network1",
+		State:          "initialising",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+	}
+	stateStore.Add("host4", host4)
+
+	changes := planner.Plan_KullUnusedServers(config, stateStore)
+	if len(changes) != 1 || changes[0].Type != "kill_server" && changes[0].HostId != "host3" {
 		t.Errorf("%+v", changes)
 	}
+
+}
+
+func TestPlan__Plan_BasicConsolidation(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+	//state.Audit.Init(&config)
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: make([]model.SecurityGroup, 0),
+	}
+
+	config.Add("app1", &model.ApplicationConfiguration{
+		Name:               "app1",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+	config.Add("app2", &model.ApplicationConfiguration{
+		Name:               "app2",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+	config.Add("app3", &model.ApplicationConfiguration{
+		Name:               "app3",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+
+	host1 := &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app1", Version: "1", State: "running"}, {Name: "app2", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host1", host1)
+
+	host2 := &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app3", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host2", host2)
+
+	host3 := &model.Host{
+		Id:             "host4",
+		Network:        "network1",
+		State:          "initialising",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+	}
+	stateStore.Add("host3", host3)
+
+	/* The new copy goes in first */
+	changes := planner.Plan_Consolidate(config, stateStore)
+	if len(changes) != 1 || changes[0].Type != "add_application" || changes[0].ApplicationName != "app3" || changes[0].HostId != "host1" {
+		t.Errorf("%+v", changes)
+	}
+
+	if planner.consolidation == nil || planner.consolidation.Savings != 1 || planner.consolidation.Freed[0] != "host2" {
+		t.Errorf("%+v", planner.consolidation)
+	}
+
+	/* Nothing more happens until the add has landed */
+	host1.Changes = []model.ChangeApplication{{Type: "add_application", Name: "app3", HostId: "host1"}}
+	changes = planner.Plan_Consolidate(config, stateStore)
+	if len(changes) != 0 {
+		t.Errorf("%+v", changes)
+	}
+
+	host1.Changes = []model.ChangeApplication{}
+	host1.Apps = append(host1.Apps, model.Application{Name: "app3", Version: "1", State: "running"})
+	changes = planner.Plan_Consolidate(config, stateStore)
+	if len(changes) != 1 || changes[0].Type != "remove_application" || changes[0].ApplicationName != "app3" || changes[0].HostId != "host2" {
+		t.Errorf("%+v", changes)
+	}
+
+	host2.Apps = []model.Application{}
+	changes = planner.Plan_Consolidate(config, stateStore)
+	if len(changes) != 0 || planner.consolidation != nil {
+		t.Errorf("%+v %+v", changes, planner.consolidation)
+	}
+}
+
+func TestPlan__Plan_ConsolidationKeepsTheNewCopy(t *testing.T) {
+	settings := defaultSettings()
+	settings.ServerCapacity = 3
+	planner, config, stateStore := testStores(settings)
+
+	for _, name := range []string{"app1", "app2", "app4", "app5"} {
+		addTestApp(config, &model.ApplicationConfiguration{Name: name, MinDeployment: 1, DesiredDeployment: 1})
+	}
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app3", MinDeployment: 1, DesiredDeployment: 2})
+
+	host1 := addTestHost(stateStore, "host1", "app1", "app2")
+	addTestHost(stateStore, "host2", "app3")
+	addTestHost(stateStore, "host5", "app3", "app4", "app5")
+
+	res := appChanges(planner.Plan(config, stateStore), "app3")
+	if len(res) != 1 || res[0].Type != "add_application" || res[0].HostId != "host1" {
+		t.Fatalf("%+v", res)
+	}
+
+	/* app3 is now above desired, only the copy on the host being freed may go */
+	host1.Apps = append(host1.Apps, model.Application{Name: "app3", Version: "1", State: "running"})
+	res = appChanges(planner.Plan(config, stateStore), "app3")
+	if len(res) != 1 || res[0].Type != "remove_application" || res[0].HostId != "host2" {
+		t.Errorf("%+v", res)
+	}
 }
 
-func TestPlan__Plan_ComplexOptimise_Step1(t *testing.T) {
+func TestPlan__Plan_ConsolidationNeedsEveryAppToFit(t *testing.T) {
 	planner := BoringPlanner{}
 
 	config := configuration.ConfigurationStore{}
@@ -1175,17 +2124,14 @@ func TestPlan__Plan_ComplexOptimise_Step1(t *testing.T) {
 	}
 	stateStore.Add("host3", host3)
 
-	changes := planner.Plan_OptimiseLayout(config, stateStore)
-	fmt.Printf("changes: %+v", changes)
-	if len(changes) != 2 || changes[0].Type != "add_application" && changes[0].ApplicationName == "classwize" && changes[0].HostId != "host2" {
-		t.Errorf("%+v", changes)
-	}
-	if len(changes) != 2 || changes[1].Type != "remove_application" && changes[0].ApplicationName == "classwize" && changes[1].HostId != "host1" {
+	/* Every app on the spot hosts already runs on the other hosts, so nothing can be freed */
+	changes := planner.Plan_Consolidate(config, stateStore)
+	if len(changes) != 0 || planner.consolidation != nil {
 		t.Errorf("%+v", changes)
 	}
 }
 
-func TestPlan__Plan_ComplexOptimise_Step2(t *testing.T) {
+func TestPlan__Plan_ConsolidationKeepsReliableAppsOffSpot(t *testing.T) {
 	planner := BoringPlanner{}
 
 	config := configuration.ConfigurationStore{}
@@ -1239,9 +2185,9 @@ func TestPlan__Plan_ComplexOptimise_Step2(t *testing.T) {
 		Id:             "host1",
 		Network:        "network1",
 		State:          "running",
-		SpotInstance:   true,
+		SpotInstance:   false,
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "surfwizeweb", Version: "1", State: "running"}, {Name: "surfwizeauth", Version: "1", State: "running"}},
+		Apps:           []model.Application{{Name: "surfwizeweb", Version: "1", State: "running"}},
 	}
 	stateStore.Add("host1", host1)
 
@@ -1251,7 +2197,7 @@ func TestPlan__Plan_ComplexOptimise_Step2(t *testing.T) {
 		State:          "running",
 		SpotInstance:   true,
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "mylinewize", Version: "1", State: "running"}, {Name: "surfwizeauth", Version: "1", State: "running"}, {Name: "classwize", Version: "1", State: "running"}},
+		Apps:           []model.Application{{Name: "mylinewize", Version: "1", State: "running"}, {Name: "surfwizeauth", Version: "1", State: "running"}},
 	}
 	stateStore.Add("host2", host2)
 
@@ -1261,21 +2207,18 @@ func TestPlan__Plan_ComplexOptimise_Step2(t *testing.T) {
 		State:          "running",
 		SpotInstance:   false,
 		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
-		Apps:           []model.Application{{Name: "mylinewize", Version: "1", State: "running"}, {Name: "surfwizeweb", Version: "1", State: "running"}, {Name: "surfwizeauth", Version: "1", State: "running"}, {Name: "classwize", Version: "1", State: "running"}},
+		Apps:           []model.Application{{Name: "classwize", Version: "1", State: "running"}, {Name: "surfwizeauth", Version: "1", State: "running"}},
 	}
 	stateStore.Add("host3", host3)
 
-	changes := planner.Plan_OptimiseLayout(config, stateStore)
-	fmt.Printf("changes: %+v", changes)
-	if len(changes) != 2 {
+	/* surfwizeweb skips the spot host2, and host2 cannot be freed as host3 already runs surfwizeauth */
+	changes := planner.Plan_Consolidate(config, stateStore)
+	if len(changes) != 1 || changes[0].Type != "add_application" || changes[0].ApplicationName != "surfwizeweb" || changes[0].HostId != "host3" {
 		t.Errorf("%+v", changes)
 	}
 
-	if changes[0].Type != "add_application" {
-		t.Errorf("change is not valid %+v", changes[0])
-	}
-	if changes[1].Type != "remove_application" {
-		t.Errorf("change is not valid %+v", changes[1])
+	if len(planner.consolidation.Freed) != 1 || planner.consolidation.Freed[0] != "host1" {
+		t.Errorf("%+v", planner.consolidation)
 	}
 }
 
@@ -1300,13 +2243,210 @@ func TestPlan__Plan_HostWithFailedAppsAndErrors_Terminated(t *testing.T) {
 	}
 	stateStore.Add("host1", host1)
 
-	changes := planner.Plan_OptimiseLayout(config, stateStore)
+	changes := planner.Plan_Consolidate(config, stateStore)
 	fmt.Printf("changes: %+v", changes)
 	if len(changes) != 0 {
 		t.Errorf("%+v", changes)
 	}
 }
 
+func TestPlan_MultipleStagesInOneTick(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	/* app1 is below its min and only fits on host1 */
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp2"}},
+	}
+	config.Add("app1", &model.ApplicationConfiguration{
+		Name:               "app1",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+
+	/* app2 is satisfied but still has an old version lying around */
+	versionConfigApp2 := make(map[string]*model.VersionConfig)
+	versionConfigApp2["2"] = &model.VersionConfig{
+		Version:        "2",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+	}
+	config.Add("app2", &model.ApplicationConfiguration{
+		Name:               "app2",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp2,
+		Enabled:            true,
+	})
+
+	stateStore.Add("host1", &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}, {Group: "secgrp2"}},
+		Apps:           []model.Application{{Name: "app2", Version: "2", State: "running"}},
+	})
+
+	stateStore.Add("host2", &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app2", Version: "1", State: "running"}},
+	})
+
+	res := planner.Plan(config, stateStore)
+	added := false
+	removed := false
+	for _, change := range res {
+		if change.Type == "add_application" && change.ApplicationName == "app1" {
+			added = true
+		}
+		if change.Type == "remove_application" && change.ApplicationName == "app2" && change.HostId == "host2" {
+			removed = true
+		}
+	}
+
+	if !added || !removed {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_PendingChangesOnlyBlockWhatTheyTouch(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	for _, name := range []string{"app1", "app2", "app3"} {
+		network := "network1"
+		if name == "app1" {
+			network = "network2"
+		}
+
+		versionConfig := make(map[string]*model.VersionConfig)
+		versionConfig["1"] = &model.VersionConfig{
+			Version:        "1",
+			Network:        network,
+			SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		}
+		config.Add(name, &model.ApplicationConfiguration{
+			Name:               name,
+			MinDeployment:      1,
+			DesiredDeployment:  1,
+			DeploymentSchedule: schedule.DeploymentSchedule{},
+			PublishedConfig:    versionConfig,
+			Enabled:            true,
+		})
+	}
+
+	/* app1 is already on its way to host1 */
+	stateStore.Add("host1", &model.Host{
+		Id:             "host1",
+		Network:        "network2",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+		Changes:        []model.ChangeApplication{{Id: "change1", Type: "add_application", HostId: "host1", Name: "app1"}},
+	})
+
+	stateStore.Add("host2", &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+	})
+
+	/* Nothing can use host3, clean up goes ahead while the others are placed */
+	stateStore.Add("host3", &model.Host{
+		Id:             "host3",
+		Network:        "network3",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+		FirstSeen:      time.Now().Format(time.RFC3339Nano),
+	})
+
+	/* And a server is being spawned for app3 */
+	planner.ServerChanges = []*model.ChangeServer{{Id: "server1", Type: "new_server", ApplicationName: "app3"}}
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 2 || res[0].Type != "add_application" || res[0].ApplicationName != "app2" || res[0].HostId != "host2" {
+		t.Fatalf("%+v", res)
+	}
+
+	if res[1].Type != "kill_server" || res[1].HostId != "host3" {
+		t.Errorf("%+v", res[1])
+	}
+}
+
+func TestPlan_ConflictingChangesAreDeferred(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+	}
+	config.Add("app1", &model.ApplicationConfiguration{
+		Name:               "app1",
+		MinDeployment:      2,
+		DesiredDeployment:  2,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApp1,
+		Enabled:            true,
+	})
+
+	/* host1 is broken and runs app1, killing it claims app1 for this tick */
+	stateStore.Add("host1", &model.Host{
+		Id:                          "host1",
+		Network:                     "network1",
+		State:                       "running",
+		NumberOfChangeFailuresInRow: 10,
+		SecurityGroups:              []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:                        []model.Application{{Name: "app1", Version: "1", State: "running"}},
+	})
+
+	stateStore.Add("host2", &model.Host{
+		Id:             "host2",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{},
+	})
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].Type != "kill_server" || res[0].HostId != "host1" {
+		t.Errorf("%+v", res)
+	}
+}
+
 func Test_OrderingByDependencies(t *testing.T) {
 	planner := BoringPlanner{}
 
@@ -1369,3 +2509,258 @@ func Test_OrderingByDependencies(t *testing.T) {
 		fmt.Printf("app: %s\n", app.Name)
 	}
 }
+
+func Test_OrderingByDependencies_CycleDoesNotLoop(t *testing.T) {
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+
+	config.Add("app1", &model.ApplicationConfiguration{Name: "app1", Depends: []model.Dependency{{Name: "app2"}}})
+	config.Add("app2", &model.ApplicationConfiguration{Name: "app2", Depends: []model.Dependency{{Name: "app1"}}})
+	config.Add("app3", &model.ApplicationConfiguration{Name: "app3"})
+
+	items := config.GetAllConfigurationAsOrderedList()
+	if len(items) != 3 {
+		t.Errorf("%+v", items)
+	}
+}
+
+func Test_DependencyCycleIsRejected(t *testing.T) {
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+
+	config.Add("acm", &model.ApplicationConfiguration{Name: "acm"})
+	config.Add("api", &model.ApplicationConfiguration{Name: "api", Depends: []model.Dependency{{Name: "acm"}}})
+	config.Add("web", &model.ApplicationConfiguration{Name: "web", Depends: []model.Dependency{{Name: "api"}}})
+
+	if err := config.ValidateDependencies("web", []model.Dependency{{Name: "api"}, {Name: "acm"}}); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	err := config.ValidateDependencies("acm", []model.Dependency{{Name: "web"}})
+	if err == nil || err.Error() != "Dependencies of acm form a cycle: acm -> web -> api -> acm" {
+		t.Errorf("%v", err)
+	}
+
+	if err := config.ValidateDependencies("new", []model.Dependency{{Name: "new"}}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestPlan_WaitForDependencies(t *testing.T) {
+	planner := BoringPlanner{}
+
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+	planner.Init(config.GlobalSettings)
+
+	stateStore := state.StateStore{}
+	stateStore.Init(&config)
+
+	versionConfigApi := make(map[string]*model.VersionConfig)
+	versionConfigApi["2"] = &model.VersionConfig{
+		Version:        "2",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+	}
+	config.Add("api", &model.ApplicationConfiguration{
+		Name:               "api",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigApi,
+		Enabled:            true,
+	})
+
+	versionConfigWeb := make(map[string]*model.VersionConfig)
+	versionConfigWeb["1"] = &model.VersionConfig{
+		Version:        "1",
+		Network:        "network1",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+	}
+	config.Add("web", &model.ApplicationConfiguration{
+		Name:               "web",
+		MinDeployment:      1,
+		DesiredDeployment:  1,
+		DeploymentSchedule: schedule.DeploymentSchedule{},
+		PublishedConfig:    versionConfigWeb,
+		Enabled:            true,
+		Depends:            []model.Dependency{{Name: "api"}},
+	})
+
+	/* Only an old version of api is running */
+	host1 := &model.Host{
+		Id:             "host1",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "api", Version: "1", State: "running"}},
+	}
+	stateStore.Add("host1", host1)
+
+	web, _ := config.GetConfiguration("web")
+	waiting := UnsatisfiedDependencies(web, config, &stateStore)
+	if len(waiting) != 1 || waiting[0] != "api" {
+		t.Errorf("%+v", waiting)
+	}
+
+	res := planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].ApplicationName != "api" {
+		t.Errorf("%+v", res)
+	}
+
+	host1.Apps = []model.Application{{Name: "api", Version: "2", State: "running"}}
+	if len(UnsatisfiedDependencies(web, config, &stateStore)) != 0 {
+		t.Fail()
+	}
+
+	res = planner.Plan(config, stateStore)
+	if len(res) != 1 || res[0].ApplicationName != "web" {
+		t.Errorf("%+v", res)
+	}
+}
+
+func TestPlan_SnapshotReplayIsDeterministic(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	app := addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 4})
+	addTestHost(stateStore, "host1", "app1")
+	addTestHost(stateStore, "host2").Apps = []model.Application{{Name: "app1", Version: "1", State: "failed"}}
+	app.PublishedConfig["1"].EnvironmentVariables = []model.EnvironmentVariable{{Key: "DB_PASSWORD", Value: "hunter2"}}
+	config.GlobalSettings.AWSAccessKeySecret = "secret"
+
+	/* Everything the planner carries between ticks goes into the snapshot too */
+	now := time.Now()
+	planner.Now = func() time.Time {
+		return now
+	}
+	planner.NewId = SequentialIds()
+	planner.ServerChanges = []*model.ChangeServer{{Id: "server1", Type: "new_server", Network: "network1"}}
+	planner.SpotUnavailable = true
+	config.Add("app2", &model.ApplicationConfiguration{
+		Name:              "app2",
+		MinDeployment:     1,
+		DesiredDeployment: 2,
+		PublishedConfig:   map[string]*model.VersionConfig{"1": {Version: "1", Network: "network1", SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}}}},
+		Enabled:           true,
+	})
+	stateStore.GetAllHosts()["host1"].Apps = append(stateStore.GetAllHosts()["host1"].Apps, model.Application{Name: "app2", Version: "1", State: "running"})
+	stateStore.Add("host3", &model.Host{
+		Id:             "host3",
+		Network:        "network1",
+		State:          "running",
+		SecurityGroups: []model.SecurityGroup{{Group: "secgrp1"}},
+		Apps:           []model.Application{{Name: "app2", Version: "1", State: "running"}},
+		FirstSeen:      now.Format(time.RFC3339Nano),
+	})
+	planner.consolidation = &consolidation{
+		Started:   now,
+		Moves:     []consolidationMove{{ApplicationName: "app2", From: "host1", To: "host3"}},
+		Freed:     []string{"host1"},
+		Announced: true,
+	}
+
+	snapshot, err := planner.Snapshot(config, stateStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := snapshot.Serialise()
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "secret") {
+		t.Errorf("%s", data)
+	}
+
+	/* The live configuration is left alone */
+	if app.PublishedConfig["1"].EnvironmentVariables[0].Value != "hunter2" {
+		t.Fail()
+	}
+
+	loaded, err := LoadSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.SpotUnavailable || len(loaded.ServerChanges) != 1 || loaded.Consolidation == nil || len(loaded.Consolidation.Moves) != 1 {
+		t.Errorf("%+v", loaded)
+	}
+
+	/* The replay plans exactly what the trainer did from the original state */
+	original, _ := json.MarshalIndent(planner.Plan(config, stateStore), "", "  ")
+	first, _ := loaded.Replay()
+	if string(first) != string(original) {
+		t.Fatalf("%s\n%s", original, first)
+	}
+
+	for i := 0; i < 10; i++ {
+		again, _ := loaded.Replay()
+		if string(again) != string(first) {
+			t.Fatalf("%s\n%s", first, again)
+		}
+	}
+
+	if !strings.Contains(string(first), "change-1") || !strings.Contains(string(first), "CONSOLIDATION") {
+		t.Errorf("%s", first)
+	}
+}
+
+/* Meant for go test -race, the api takes snapshots while the main loop plans */
+func TestPlan_SnapshotWhilePlanning(t *testing.T) {
+	planner, config, stateStore := testStores(defaultSettings())
+	addTestApp(config, &model.ApplicationConfiguration{Name: "app1", MinDeployment: 1, DesiredDeployment: 2})
+	addTestHost(stateStore, "host1", "app1")
+	addTestHost(stateStore, "host2")
+	addTestHost(stateStore, "host3")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			planner.SetServerChanges([]*model.ChangeServer{{Id: fmt.Sprintf("server%d", i), Type: "new_server"}}, i%2 == 0)
+			planner.Plan(config, stateStore)
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if _, err := planner.Snapshot(config, stateStore); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPlan_canDeploy_KnownGoodAndKnownBad(t *testing.T) {
+	planner := BoringPlanner{}
+
+	versionConfigApp1 := make(map[string]*model.VersionConfig)
+	versionConfigApp1["1"] = &model.VersionConfig{
+		Version:            "1",
+		Network:            "network1",
+		DeploymentFailures: 2,
+	}
+
+	app := &model.ApplicationConfiguration{
+		Name:            "app1",
+		MinDeployment:   1,
+		PublishedConfig: versionConfigApp1,
+		Enabled:         true,
+	}
+
+	if planner.canDeploy(app) {
+		t.Errorf("version with two failures and no success should not deploy")
+	}
+
+	versionConfigApp1["1"].KnownGood = true
+	if !planner.canDeploy(app) {
+		t.Errorf("version marked known good should deploy")
+	}
+
+	versionConfigApp1["1"].KnownGood = false
+	versionConfigApp1["1"].DeploymentFailures = 0
+	versionConfigApp1["1"].KnownBad = true
+	if planner.canDeploy(app) {
+		t.Errorf("version marked known bad should not deploy")
+	}
+}
+
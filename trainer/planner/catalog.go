@@ -0,0 +1,111 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"fmt"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"sort"
+	"strings"
+)
+
+type ByPrice []configuration.InstanceCatalogEntry
+
+func (s ByPrice) Len() int {
+	return len(s)
+}
+func (s ByPrice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ByPrice) Less(i, j int) bool {
+	return s[i].Price < s[j].Price
+}
+
+func totalNeeds(apps []*model.ApplicationConfiguration) (float64, float64) {
+	var cpu, memory float64
+	for _, app := range apps {
+		needs := app.GetLatestPublishedConfiguration().Needs
+		cpu += float64(needs.CpuNeeds)
+		memory += float64(needs.MemoryNeeds)
+	}
+	return cpu, memory
+}
+
+func entryFits(entry configuration.InstanceCatalogEntry, apps []*model.ApplicationConfiguration) bool {
+	cpu, memory := totalNeeds(apps)
+	return entry.Cpu >= cpu && entry.Memory >= memory
+}
+
+/*
+	Picks the cheapest catalog type that fits every app waiting on a new server.
+	Apps that name their own instance type, or an empty catalog, keep the old behaviour.
+	The choice goes in the change reason, it is audited once the server is actually asked for.
+*/
+func (planner *BoringPlanner) selectInstanceType(change *PlanningChange, apps []*model.ApplicationConfiguration, settings configuration.GlobalSettings) {
+	if change.InstanceType != "" || len(settings.InstanceCatalog) == 0 {
+		return
+	}
+
+	names := make([]string, 0)
+	for _, app := range apps {
+		names = append(names, app.Name)
+	}
+	cpu, memory := totalNeeds(apps)
+
+	entries := make([]configuration.InstanceCatalogEntry, 0)
+	for _, entry := range settings.InstanceCatalog {
+		if entry.Provider == "" || entry.Provider == settings.CloudProvider {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Stable(ByPrice(entries))
+
+	passedOver := make([]string, 0)
+	for _, entry := range entries {
+		if change.RequiresSpotInstance && !entry.SpotEligible {
+			passedOver = append(passedOver, fmt.Sprintf("%s is not spot eligible", entry.Name))
+			continue
+		}
+
+		if !entryFits(entry, apps) {
+			passedOver = append(passedOver, fmt.Sprintf("%s is too small (%.2f cpu, %.0f memory)", entry.Name, entry.Cpu, entry.Memory))
+			continue
+		}
+
+		change.InstanceType = entry.Name
+
+		/* The cloud provider would try spot first, which this type cannot do */
+		if !change.RequiresSpotInstance && !entry.SpotEligible {
+			change.RequiresReliableInstance = true
+		}
+
+		reasoning := "it was the cheapest"
+		if len(passedOver) > 0 {
+			reasoning = "cheaper types were passed over, " + strings.Join(passedOver, ", ")
+		}
+
+		change.Reason = fmt.Sprintf("INSTANCE CATALOG: Picked %s at %.3f per hour for a new server for %s needing %.2f cpu and %.0f memory, %s",
+			entry.Name, entry.Price, strings.Join(names, ", "), cpu, memory, reasoning)
+		return
+	}
+
+	change.Reason = fmt.Sprintf("INSTANCE CATALOG: No instance type fits a new server for %s needing %.2f cpu and %.0f memory, using the default type. %s",
+		strings.Join(names, ", "), cpu, memory, strings.Join(passedOver, ", "))
+}
@@ -0,0 +1,317 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"fmt"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* A consolidation that has not finished in this time is given up on, its hosts will be picked up again next round */
+const CONSOLIDATION_TIMEOUT = time.Minute * 30
+
+type consolidationMove struct {
+	ApplicationName string
+	From            string
+	To              string
+}
+
+type consolidation struct {
+	Started time.Time
+	Moves   []consolidationMove
+	Freed   []string
+	Savings float64
+
+	/* Set once the first moves were accepted by Plan, until then the consolidation can be dropped */
+	Announced bool
+}
+
+/* Hourly price of a host, hosts without a known price count as 1 so cost falls back to host count */
+func hostCost(host *model.Host, settings configuration.GlobalSettings) float64 {
+	if host.SpotInstance && settings.AWSSpotPrice > 0 {
+		return settings.AWSSpotPrice
+	}
+
+	instanceType := host.InstanceType
+	if instanceType == "" {
+		instanceType = settings.InstanceType
+	}
+
+	if entry, ok := settings.CatalogEntry(instanceType); ok {
+		return entry.Price
+	}
+
+	if price, ok := settings.InstancePrices[instanceType]; ok {
+		return price
+	}
+	return 1
+}
+
+/* The hosts we would most like to get rid of come first */
+type ByConsolidationOrder struct {
+	Hosts
+	Settings configuration.GlobalSettings
+}
+
+func (s ByConsolidationOrder) Less(i, j int) bool {
+	costI := hostCost(s.Hosts[i], s.Settings)
+	costJ := hostCost(s.Hosts[j], s.Settings)
+	appsI := len(s.Hosts[i].Apps)
+	appsJ := len(s.Hosts[j].Apps)
+
+	if s.Settings.ConsolidationObjective == configuration.CONSOLIDATE__COST && costI != costJ {
+		return costI > costJ
+	}
+
+	if appsI != appsJ {
+		return appsI < appsJ
+	}
+	return costI > costJ
+}
+
+func hasPendingAdd(host *model.Host, application string) bool {
+	for _, change := range host.Changes {
+		if change.Type == "add_application" && change.Name == application {
+			return true
+		}
+	}
+	return false
+}
+
+/* Could this host take a copy of the app being moved off another host, given the moves we have planned so far? */
+func (planner *BoringPlanner) canReceive(host *model.Host, source *model.Host, app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore, currentState *state.StateStore, planned []PlanningChange) bool {
+	if host.Id == source.Id || host.HasApp(app.Name) || len(host.Changes) > 0 {
+		return false
+	}
+
+	/* A moved copy must count towards the same share of the spot policy, so never reliable to spot and spot to reliable only without a policy */
+	if host.SpotInstance && !source.SpotInstance {
+		return false
+	}
+
+	if !host.SpotInstance && source.SpotInstance && app.SpotPolicy.Mode != model.SPOT__DEFAULT {
+		return false
+	}
+
+	for _, change := range planned {
+		if change.Type == "add_application" && change.HostId == host.Id && change.ApplicationName == app.Name {
+			return false
+		}
+	}
+
+	return hostIsSuitable(host, app) &&
+		planner.hostHasCorrectAffinity(host, app) &&
+		planner.hostHasCorrectInstanceType(host, app, configurationStore) &&
+		planner.hostHasCapacity(host, configurationStore, planned) &&
+		planner.hostSatisfiesSpread(host, app, currentState, planned, source.Id) &&
+		planner.hostSatisfiesAntiAffinity(host, app, configurationStore, planned)
+}
+
+/*
+	Works out which hosts can be emptied by moving every app on them onto the remaining hosts.
+	Hosts are tried cheapest to free first, and apps go to the fullest host that can take them.
+*/
+func (planner *BoringPlanner) planConsolidation(configurationStore configuration.ConfigurationStore, currentState state.StateStore) *consolidation {
+	sources := currentState.ListOfHosts()
+	sort.Stable(ByConsolidationOrder{sources, configurationStore.GlobalSettings})
+
+	targets := currentState.ListOfHosts()
+	sort.Stable(sort.Reverse(ByApplicationCount{targets}))
+
+	plan := &consolidation{Started: planner.now()}
+	planned := make([]PlanningChange, 0)
+	freed := make(map[string]bool)
+	receiving := make(map[string]bool)
+
+	for _, source := range sources {
+		if source.Cordoned || len(source.Apps) == 0 || len(source.Changes) > 0 || receiving[source.Id] {
+			continue
+		}
+
+		trial := extend(planned, nil)
+		moves := make([]consolidationMove, 0)
+		toMove := 0
+		for _, app := range source.Apps {
+			/* Daemons are not moved, they go with the host and the new host already has its own */
+			if isDaemon(configurationStore, app.Name) {
+				continue
+			}
+			toMove += 1
+
+			appConfiguration, err := configurationStore.GetConfiguration(app.Name)
+			if err != nil || appConfiguration.IsJob() || app.State != "running" || app.Version != appConfiguration.GetLatestPublishedVersion() {
+				break
+			}
+
+			for _, target := range targets {
+				if freed[target.Id] || !planner.canReceive(target, source, appConfiguration, configurationStore, &currentState, trial) {
+					continue
+				}
+
+				trial = append(trial, PlanningChange{Type: "add_application", ApplicationName: app.Name, HostId: target.Id})
+				trial = append(trial, PlanningChange{Type: "remove_application", ApplicationName: app.Name, HostId: source.Id})
+				moves = append(moves, consolidationMove{ApplicationName: app.Name, From: source.Id, To: target.Id})
+				break
+			}
+
+			if len(moves) == 0 || moves[len(moves)-1].ApplicationName != app.Name {
+				break
+			}
+		}
+
+		if toMove == 0 || len(moves) != toMove {
+			continue
+		}
+
+		planned = trial
+		freed[source.Id] = true
+		for _, move := range moves {
+			receiving[move.To] = true
+		}
+		plan.Moves = append(plan.Moves, moves...)
+		plan.Freed = append(plan.Freed, source.Id)
+		plan.Savings += hostCost(source, configurationStore.GlobalSettings)
+	}
+
+	if len(plan.Moves) == 0 {
+		return nil
+	}
+	return plan
+}
+
+/* Is a copy of the app still waiting to leave a host being freed? Its extra copy is then removed by Plan_Consolidate and no one else */
+func (planner *BoringPlanner) isConsolidating(application string, currentState *state.StateStore) bool {
+	if planner.consolidation == nil || !planner.consolidation.Announced {
+		return false
+	}
+
+	for _, move := range planner.consolidation.Moves {
+		if move.ApplicationName != application {
+			continue
+		}
+
+		source, err := currentState.GetConfiguration(move.From)
+		if err == nil && source.HasApp(application) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	A new consolidation was worked out from a fleet other stages may be changing this tick.
+	It only stands once its first moves go out, otherwise it is worked out again from the next state.
+*/
+func (planner *BoringPlanner) settleConsolidation(deferred bool) {
+	if planner.consolidation == nil || planner.consolidation.Announced {
+		return
+	}
+
+	if deferred {
+		planner.consolidation = nil
+		return
+	}
+
+	planner.consolidation.Announced = true
+	planner.audit(state.AuditEvent{Severity: state.AUDIT__INFO,
+		Message: fmt.Sprintf("CONSOLIDATION: Moving %d applications to free hosts %s, expected saving %.3f per hour",
+			len(planner.consolidation.Moves), strings.Join(planner.consolidation.Freed, ", "), planner.consolidation.Savings),
+	})
+}
+
+/*
+	Replaces the old one move at a time layout optimisation.
+	Every app is added to its new host first and only removed from the old one once the new copy is running,
+	so min counts hold throughout. The freed hosts are then left empty for Plan_KullUnusedServers.
+*/
+func (planner *BoringPlanner) Plan_Consolidate(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
+	ret := make([]PlanningChange, 0)
+
+	if planner.consolidation == nil {
+		planner.consolidation = planner.planConsolidation(configurationStore, currentState)
+		if planner.consolidation == nil {
+			return ret
+		}
+	}
+
+	if planner.now().Sub(planner.consolidation.Started) > CONSOLIDATION_TIMEOUT {
+		planner.audit(state.AuditEvent{Severity: state.AUDIT__ERROR,
+			Message: fmt.Sprintf("CONSOLIDATION: Gave up freeing hosts %s, moves did not finish in time", strings.Join(planner.consolidation.Freed, ", ")),
+		})
+		planner.consolidation = nil
+		return ret
+	}
+
+	remaining := make([]consolidationMove, 0)
+	for _, move := range planner.consolidation.Moves {
+		source, err := currentState.GetConfiguration(move.From)
+		if err != nil || !source.HasApp(move.ApplicationName) {
+			continue
+		}
+
+		target, err := currentState.GetConfiguration(move.To)
+		if err != nil || target.State != "running" || target.Cordoned {
+			planner.audit(state.AuditEvent{Severity: state.AUDIT__ERROR,
+				Message: fmt.Sprintf("CONSOLIDATION: Gave up freeing hosts %s, host %s is no longer available", strings.Join(planner.consolidation.Freed, ", "), move.To),
+				HostId:  move.To,
+			})
+			planner.consolidation = nil
+			return make([]PlanningChange, 0)
+		}
+		remaining = append(remaining, move)
+
+		appConfiguration, err := configurationStore.GetConfiguration(move.ApplicationName)
+		if err != nil {
+			continue
+		}
+
+		if target.HasAppWithSameVersionRunning(move.ApplicationName, appConfiguration.GetLatestPublishedVersion()) {
+			ret = append(ret, PlanningChange{
+				Type:            "remove_application",
+				ApplicationName: move.ApplicationName,
+				HostId:          move.From,
+				Id:              planner.newId(),
+				Reason:          fmt.Sprintf("CONSOLIDATION: Application %s is running on host %s, removing it from host %s", move.ApplicationName, move.To, move.From),
+			})
+		} else if !target.HasApp(move.ApplicationName) && !hasPendingAdd(target, move.ApplicationName) {
+			ret = append(ret, PlanningChange{
+				Type:            "add_application",
+				ApplicationName: move.ApplicationName,
+				HostId:          move.To,
+				Id:              planner.newId(),
+			})
+		}
+	}
+
+	if len(remaining) == 0 {
+		planner.audit(state.AuditEvent{Severity: state.AUDIT__INFO,
+			Message: fmt.Sprintf("CONSOLIDATION: Hosts %s are now free", strings.Join(planner.consolidation.Freed, ", ")),
+		})
+		planner.consolidation = nil
+		return ret
+	}
+
+	planner.consolidation.Moves = remaining
+	return ret
+}
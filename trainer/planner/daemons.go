@@ -0,0 +1,103 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"fmt"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+)
+
+/* Daemons ride along on whatever hosts there are, so they neither use up a hosts capacity nor keep it alive */
+func isDaemon(configurationStore configuration.ConfigurationStore, name string) bool {
+	app, err := configurationStore.GetConfiguration(name)
+	return err == nil && app.IsDaemon()
+}
+
+/* Why the daemon should not be on this host, empty when it should */
+func (planner *BoringPlanner) daemonRejection(host *model.Host, app *model.ApplicationConfiguration, configurationStore configuration.ConfigurationStore, planned []PlanningChange) string {
+	if reason := hostUnsuitableReason(host, app); reason != "" {
+		return reason
+	}
+
+	if host.Draining {
+		return "host is draining"
+	}
+
+	if !planner.hostHasCorrectAffinity(host, app) {
+		return "affinity does not match"
+	}
+
+	if !planner.hostSatisfiesAntiAffinity(host, app, configurationStore, planned) {
+		return "anti affinity"
+	}
+	return ""
+}
+
+/*
+	Keeps exactly one copy of every daemon on each running host that matches it, and takes it off hosts that no longer do.
+	Runs ahead of the Min and Desired stages so a host that has just checked in gets its daemons first.
+*/
+func (planner *BoringPlanner) Plan_Daemons(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
+	ret := make([]PlanningChange, 0)
+
+	for _, app := range configurationStore.GetAllConfigurationAsOrderedList() {
+		if !app.IsDaemon() || app.GetLatestPublishedConfiguration() == nil {
+			continue
+		}
+
+		for _, hostEntity := range currentState.ListOfHosts() {
+			rejected := "application is disabled"
+			if app.Enabled {
+				rejected = planner.daemonRejection(hostEntity, app, configurationStore, ret)
+			}
+
+			/* Cordoned and draining hosts keep what they have, hosts that are not running yet may still turn out to match */
+			if rejected != "" {
+				if hostEntity.HasApp(app.Name) && hostEntity.State == "running" && !hostEntity.Cordoned && !hostEntity.Draining {
+					ret = append(ret, PlanningChange{
+						Type:            "remove_application",
+						ApplicationName: app.Name,
+						HostId:          hostEntity.Id,
+						Id:              planner.newId(),
+						Reason:          fmt.Sprintf("DAEMON: Host %s no longer matches daemon %s, %s", hostEntity.Id, app.Name, rejected),
+					})
+					planner.decide(PlanDecision{ApplicationName: app.Name, Chosen: hostEntity.Id, Reason: "daemon comes off a host it no longer matches, " + rejected})
+				}
+				continue
+			}
+
+			/* A copy that is starting or failing is left to Plan_KullBrokenApplications */
+			if hostEntity.HasAppWithSameVersion(app.Name, app.GetLatestPublishedVersion()) || hasPendingAdd(hostEntity, app.Name) {
+				continue
+			}
+
+			ret = append(ret, PlanningChange{
+				Type:            "add_application",
+				ApplicationName: app.Name,
+				HostId:          hostEntity.Id,
+				Id:              planner.newId(),
+				Reason:          fmt.Sprintf("DAEMON: Host %s matches daemon %s", hostEntity.Id, app.Name),
+			})
+			planner.decide(PlanDecision{ApplicationName: app.Name, Chosen: hostEntity.Id, Reason: "daemon runs on every matching host"})
+		}
+	}
+	return ret
+}
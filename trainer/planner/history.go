@@ -0,0 +1,92 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"time"
+)
+
+/* Roughly an hour of plans at one plan every 20 seconds */
+const PLAN_HISTORY_LENGTH = 180
+
+/* Chosen on a decision when the app is waiting for a new server rather than an existing host */
+const NEW_SERVER_DECISION = "new_server"
+
+type HostConsideration struct {
+	HostId   string
+	Rejected string /* Empty when the host was chosen */
+}
+
+type PlanDecision struct {
+	Time            string
+	Stage           string
+	ApplicationName string
+	Considered      []HostConsideration
+	Chosen          string
+	Reason          string
+}
+
+type PlanRecord struct {
+	Time      string
+	Changes   []PlanningChange
+	Decisions []PlanDecision
+}
+
+func (planner *BoringPlanner) decide(decision PlanDecision) {
+	planner.decisions = append(planner.decisions, decision)
+}
+
+func (planner *BoringPlanner) record(changes []PlanningChange) {
+	now := planner.now().Format(time.RFC3339Nano)
+	for i := range planner.decisions {
+		planner.decisions[i].Time = now
+	}
+
+	planner.historyLock.Lock()
+	defer planner.historyLock.Unlock()
+
+	planner.history = append(planner.history, PlanRecord{Time: now, Changes: changes, Decisions: planner.decisions})
+	if len(planner.history) > PLAN_HISTORY_LENGTH {
+		planner.history = planner.history[len(planner.history)-PLAN_HISTORY_LENGTH:]
+	}
+	planner.decisions = make([]PlanDecision, 0)
+}
+
+/* Oldest plan first, read by the api while the planner keeps running */
+func (planner *BoringPlanner) History() []PlanRecord {
+	planner.historyLock.Lock()
+	defer planner.historyLock.Unlock()
+
+	ret := make([]PlanRecord, len(planner.history))
+	copy(ret, planner.history)
+	return ret
+}
+
+/* Every decision made about one application across the kept history, oldest first */
+func (planner *BoringPlanner) Explain(application string) []PlanDecision {
+	ret := make([]PlanDecision, 0)
+	for _, record := range planner.History() {
+		for _, decision := range record.Decisions {
+			if decision.ApplicationName == application {
+				ret = append(ret, decision)
+			}
+		}
+	}
+	return ret
+}
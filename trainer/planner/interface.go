@@ -36,10 +36,15 @@ type PlanningChange struct {
 	InstanceType string
 
 	RequiresReliableInstance bool
+	RequiresSpotInstance bool
 	Network string
 	SecurityGroups []model.SecurityGroup
 	GroupingTag	string
+	Labels	map[string]string
 
 	Reason	string
+
+	/* Set when the add_application starts a run of this job */
+	JobId	string
 }
 
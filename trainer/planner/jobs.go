@@ -0,0 +1,153 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"fmt"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+)
+
+func plannedAdd(planned []PlanningChange, appName string, hostId string) bool {
+	for _, change := range planned {
+		if change.Type == "add_application" && change.ApplicationName == appName && change.HostId == hostId {
+			return true
+		}
+	}
+	return false
+}
+
+func activeRunOn(currentState *state.StateStore, appName string, hostId string) bool {
+	for _, job := range currentState.ListOfApplicationJobs(appName) {
+		if job.ActiveRunOn(hostId) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/* Job apps left on a host with no run going there have finished, or belong to a job that was given up on */
+func (planner *BoringPlanner) removeFinishedRuns(configurationStore configuration.ConfigurationStore, currentState *state.StateStore) []PlanningChange {
+	ret := make([]PlanningChange, 0)
+	for _, hostEntity := range currentState.ListOfHosts() {
+		for _, app := range hostEntity.Apps {
+			appConfiguration, err := configurationStore.GetConfiguration(app.Name)
+			if err != nil || !appConfiguration.IsJob() || activeRunOn(currentState, app.Name, hostEntity.Id) {
+				continue
+			}
+
+			ret = append(ret, PlanningChange{
+				Type:            "remove_application",
+				ApplicationName: app.Name,
+				HostId:          hostEntity.Id,
+				Id:              planner.newId(),
+				Reason:          fmt.Sprintf("JOB: Application %s has no run going on host %s, removing it", app.Name, hostEntity.Id),
+			})
+		}
+	}
+	return ret
+}
+
+/*
+	Keeps each job at its parallelism until it has its completions, and cleans up after runs that finished.
+	Runs are placed by the same rules as services, with at most one run of a job on a host.
+*/
+func (planner *BoringPlanner) Plan_RunJobs(configurationStore configuration.ConfigurationStore, currentState state.StateStore) []PlanningChange {
+	ret := planner.removeFinishedRuns(configurationStore, &currentState)
+
+	for _, job := range currentState.ListOfJobs() {
+		app, err := configurationStore.GetConfiguration(job.Application)
+		if err != nil || !app.IsJob() || !app.Enabled || job.IsFinished() || job.PastDeadline(planner.now()) {
+			continue
+		}
+
+		/* A newer version is about to supersede this job */
+		if app.GetLatestPublishedConfiguration() == nil || app.GetLatestPublishedVersion() != job.Version {
+			continue
+		}
+
+		active, succeeded, failed := job.Counts()
+		if failed > job.Spec.RetryLimit {
+			continue
+		}
+
+		wanted := job.Spec.RunsAtOnce() - active
+		if remaining := job.Spec.NeededCompletions() - succeeded - active; remaining < wanted {
+			wanted = remaining
+		}
+
+		for i := 0; i < wanted; i++ {
+			decision := PlanDecision{ApplicationName: app.Name}
+			for _, hostEntity := range planner.hostsByPreference(currentState.ListOfHosts(), app) {
+				rejected := planner.hostRejection(hostEntity, app, configurationStore, &currentState, ret, ANY_HOST)
+				if rejected == "" && (hostEntity.HasApp(app.Name) || plannedAdd(ret, app.Name, hostEntity.Id)) {
+					rejected = "already has a run of this job"
+				}
+
+				decision.Considered = append(decision.Considered, HostConsideration{HostId: hostEntity.Id, Rejected: rejected})
+				if rejected != "" {
+					continue
+				}
+
+				ret = append(ret, PlanningChange{
+					Type:            "add_application",
+					ApplicationName: app.Name,
+					HostId:          hostEntity.Id,
+					Id:              planner.newId(),
+					JobId:           job.Id,
+				})
+				decision.Chosen = hostEntity.Id
+				decision.Reason = fmt.Sprintf("run for job %s", job.Id)
+				break
+			}
+
+			if decision.Chosen != "" {
+				planner.decide(decision)
+				continue
+			}
+
+			/* Out of hosts, ask for one server per tick and place the rest once it is up */
+			if planner.findServerInChanges(ret, app) >= 0 {
+				decision.Reason = "a server planned this round will take it"
+			} else if !planner.fleetHasRoom(&currentState, ret) {
+				decision.Reason = "fleet is at MaxHostCount"
+			} else {
+				change := PlanningChange{
+					Type:            "new_server",
+					Id:              planner.newId(),
+					ApplicationName: app.Name,
+					Network:         app.GetLatestPublishedConfiguration().Network,
+					SecurityGroups:  app.GetLatestPublishedConfiguration().SecurityGroups,
+					GroupingTag:     app.GetLatestPublishedConfiguration().GroupingTag,
+					InstanceType:    app.GetLatestPublishedConfiguration().InstanceType,
+					Labels:          app.GetLatestPublishedConfiguration().Placement.RequiredLabels(),
+				}
+				planner.selectInstanceType(&change, []*model.ApplicationConfiguration{app}, configurationStore.GlobalSettings)
+
+				ret = append(ret, change)
+				decision.Chosen = NEW_SERVER_DECISION
+				decision.Reason = fmt.Sprintf("no existing host can take a run for job %s", job.Id)
+			}
+			planner.decide(decision)
+			break
+		}
+	}
+	return ret
+}
@@ -0,0 +1,167 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"encoding/json"
+	"fmt"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"sort"
+	"time"
+)
+
+const REDACTED = "REDACTED"
+
+/* Everything Plan looks at, with credentials and application secrets removed so it can be attached to a bug report */
+type Snapshot struct {
+	Time            time.Time
+	Settings        configuration.GlobalSettings
+	Applications    []*model.ApplicationConfiguration
+	Hosts           []*model.Host
+	ServerChanges   []*model.ChangeServer
+	SpotUnavailable bool
+	Jobs            []*state.Job
+
+	/* The consolidation in progress, later ticks carry on with its moves rather than planning a new one */
+	Consolidation *consolidation
+}
+
+type ApplicationsByName []*model.ApplicationConfiguration
+
+func (s ApplicationsByName) Len() int {
+	return len(s)
+}
+func (s ApplicationsByName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ApplicationsByName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+func redactVersions(versions map[string]*model.VersionConfig) {
+	for _, version := range versions {
+		version.DockerConfig.Username = ""
+		version.DockerConfig.Password = ""
+		version.DockerConfig.Email = ""
+		for i := range version.EnvironmentVariables {
+			version.EnvironmentVariables[i].Value = REDACTED
+		}
+		for i := range version.Files {
+			version.Files[i].Base64FileContents = ""
+		}
+	}
+}
+
+/* Called from the api, it waits for a Plan in progress so it never sees its fields half written */
+func (planner *BoringPlanner) Snapshot(configurationStore configuration.ConfigurationStore, currentState state.StateStore) (*Snapshot, error) {
+	planner.planLock.Lock()
+	defer planner.planLock.Unlock()
+
+	snapshot := &Snapshot{
+		Time:            planner.now(),
+		Settings:        configurationStore.GlobalSettings.Redacted(),
+		Applications:    make([]*model.ApplicationConfiguration, 0),
+		Hosts:           currentState.ListOfAllHosts(),
+		ServerChanges:   planner.ServerChanges,
+		SpotUnavailable: planner.SpotUnavailable,
+		Jobs:            currentState.ListOfJobs(),
+		Consolidation:   planner.consolidation,
+	}
+
+	for _, app := range configurationStore.GetAllConfiguration() {
+		snapshot.Applications = append(snapshot.Applications, app)
+	}
+	sort.Sort(ApplicationsByName(snapshot.Applications))
+
+	/* Going through json gives us a deep copy to redact without touching the live configuration */
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := LoadSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range ret.Applications {
+		redactVersions(app.Config)
+		redactVersions(app.PublishedConfig)
+	}
+	return ret, nil
+}
+
+func (snapshot *Snapshot) Serialise() ([]byte, error) {
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+func LoadSnapshot(data []byte) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+/* Change ids for replays, counting up from change-1 */
+func SequentialIds() func() string {
+	next := 0
+	return func() string {
+		next += 1
+		return fmt.Sprintf("change-%d", next)
+	}
+}
+
+/*
+	Runs the snapshot through a fresh planner, the same snapshot always gives byte for byte the same plan.
+	Audit events of the replay are dropped, so it never reaches the audit log or its webhooks.
+*/
+func (snapshot *Snapshot) Replay() ([]byte, error) {
+	configurationStore := configuration.ConfigurationStore{}
+	configurationStore.Init("")
+	configurationStore.GlobalSettings = snapshot.Settings
+	for _, app := range snapshot.Applications {
+		configurationStore.Add(app.Name, app)
+	}
+
+	currentState := state.StateStore{}
+	currentState.Init(&configurationStore)
+	for _, host := range snapshot.Hosts {
+		currentState.Add(host.Id, host)
+	}
+
+	for _, job := range snapshot.Jobs {
+		currentState.AddJob(job)
+	}
+
+	replayPlanner := &BoringPlanner{}
+	replayPlanner.Init(snapshot.Settings)
+	replayPlanner.ServerChanges = snapshot.ServerChanges
+	replayPlanner.SpotUnavailable = snapshot.SpotUnavailable
+	replayPlanner.consolidation = snapshot.Consolidation
+	replayPlanner.Audit = func(event state.AuditEvent) {}
+	replayPlanner.NewId = SequentialIds()
+	replayPlanner.Now = func() time.Time {
+		return snapshot.Time
+	}
+
+	return json.MarshalIndent(replayPlanner.Plan(configurationStore, currentState), "", "  ")
+}
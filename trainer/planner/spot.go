@@ -0,0 +1,133 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package planner
+
+import (
+	"orca/trainer/model"
+	"orca/trainer/state"
+)
+
+type hostKind int
+
+const (
+	ANY_HOST hostKind = iota
+	RELIABLE_HOST
+	SPOT_HOST
+)
+
+/* Why a host of the wrong kind is passed over, empty when it will do */
+func kindRejection(host *model.Host, kind hostKind) string {
+	if kind == RELIABLE_HOST && host.SpotInstance {
+		return "spot instance, this replica needs a reliable host"
+	}
+
+	if kind == SPOT_HOST && !host.SpotInstance {
+		return "reliable host, the spot policy puts this replica on spot"
+	}
+	return ""
+}
+
+/* Replicas that must be on reliable hosts, and the most that may be on spot hosts or -1 for no limit */
+func (planner *BoringPlanner) spotSplit(app *model.ApplicationConfiguration) (int, int) {
+	desired := app.TargetDesiredDeployment()
+	if app.TargetMinDeployment() > desired {
+		desired = app.TargetMinDeployment()
+	}
+
+	policy := app.SpotPolicy
+	reliable, spot := app.TargetMinDeployment(), -1
+	switch policy.Mode {
+	case model.SPOT__NEVER:
+		reliable, spot = desired, 0
+	case model.SPOT__ONLY:
+		reliable, spot = 0, -1
+	case model.SPOT__PERCENTAGE:
+		spot = desired * policy.Percentage / 100
+		reliable = desired - spot
+	case model.SPOT__COUNT:
+		spot = policy.Count
+		if spot > desired {
+			spot = desired
+		}
+		reliable = desired - spot
+	}
+
+	if policy.Mode != model.SPOT__DEFAULT && planner.SpotUnavailable && reliable < policy.ReliabilityFloor {
+		reliable = policy.ReliabilityFloor
+		if reliable > desired {
+			reliable = desired
+		}
+	}
+	return reliable, spot
+}
+
+/* Running replicas of the latest version on reliable and on spot hosts, draining hosts do not count */
+func (planner *BoringPlanner) replicaCounts(app *model.ApplicationConfiguration, currentState *state.StateStore) (int, int) {
+	reliable, spot := 0, 0
+	for _, hostEntity := range currentState.ListOfHosts() {
+		if hostEntity.Draining || !hostEntity.HasAppWithSameVersionRunning(app.Name, app.GetLatestPublishedVersion()) {
+			continue
+		}
+
+		if hostEntity.SpotInstance {
+			spot += 1
+		} else {
+			reliable += 1
+		}
+	}
+	return reliable, spot
+}
+
+/* Where a replica beyond the reliable ones should go */
+func (planner *BoringPlanner) extraReplicaKind(app *model.ApplicationConfiguration, spotCount int) hostKind {
+	_, spotLimit := planner.spotSplit(app)
+	switch app.SpotPolicy.Mode {
+	case model.SPOT__NEVER:
+		return RELIABLE_HOST
+	case model.SPOT__ONLY:
+		return SPOT_HOST
+	case model.SPOT__PERCENTAGE, model.SPOT__COUNT:
+		if spotCount < spotLimit {
+			return SPOT_HOST
+		}
+		return RELIABLE_HOST
+	}
+	return ANY_HOST
+}
+
+/* The kind of host the Min stage should place the next replica on, false once the reliable and min counts are both met */
+func (planner *BoringPlanner) minReplicaKind(app *model.ApplicationConfiguration, currentState *state.StateStore) (hostKind, bool) {
+	reliableTarget, _ := planner.spotSplit(app)
+	reliable, spot := planner.replicaCounts(app, currentState)
+
+	if reliable < reliableTarget {
+		return RELIABLE_HOST, true
+	}
+
+	if reliable+spot < app.TargetMinDeployment() {
+		return planner.extraReplicaKind(app, spot), true
+	}
+	return ANY_HOST, false
+}
+
+/* Fills in which kind of instance a new server has to be */
+func requestInstanceKind(change *PlanningChange, kind hostKind) {
+	change.RequiresReliableInstance = kind == RELIABLE_HOST
+	change.RequiresSpotInstance = kind == SPOT_HOST
+}
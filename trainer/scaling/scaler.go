@@ -0,0 +1,321 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package scaling
+
+import (
+	"fmt"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* How far back we look in app_utilisation, the metrics ticker writes every 2 minutes */
+const METRIC_WINDOW = time.Minute * 6
+
+/* Queue depths older than this are ignored, the monitor polls every 10 seconds */
+const QUEUE_OBSERVATION_TTL = time.Minute * 2
+
+type recommendation struct {
+	Time  time.Time
+	Value int
+}
+
+type queueObservation struct {
+	Depth      int
+	Time       time.Time
+	EmptySince time.Time
+}
+
+type Scaler struct {
+	history       map[string][]recommendation
+	lastScaleUp   map[string]time.Time
+	lastScaleDown map[string]time.Time
+
+	/* Written from the monitor loop and read from the planner loop */
+	queueLock sync.Mutex
+	queues    map[string]queueObservation
+}
+
+func (scaler *Scaler) Init() {
+	scaler.history = make(map[string][]recommendation)
+	scaler.lastScaleUp = make(map[string]time.Time)
+	scaler.lastScaleDown = make(map[string]time.Time)
+	scaler.queues = make(map[string]queueObservation)
+}
+
+func metricValue(policy model.AutoscalePolicy, sample state.ApplicationUtilisationStatistic) int64 {
+	switch policy.Metric {
+	case model.AUTOSCALE__MEMORY:
+		return sample.Mbytes
+	case model.AUTOSCALE__NETWORK:
+		return sample.Network
+	}
+	return sample.Cpu
+}
+
+/* Number of instances needed so the average per instance sits at the target, -1 when there is nothing to go on */
+func Recommend(policy model.AutoscalePolicy, samples []state.ApplicationUtilisationStatistic) int {
+	if policy.Target <= 0 || len(samples) == 0 {
+		return -1
+	}
+
+	var total int64
+	for _, sample := range samples {
+		total += metricValue(policy, sample)
+	}
+	average := total / int64(len(samples))
+
+	needed := average / policy.Target
+	if average%policy.Target != 0 {
+		needed += 1
+	}
+	return bound(int(needed), policy.MinInstances, policy.MaxInstances)
+}
+
+/* Number of consumers needed to keep each one at MessagesPerInstance, -1 if the policy is unusable */
+func RecommendFromQueue(policy model.QueueAutoscalePolicy, depth int) int {
+	if policy.MessagesPerInstance <= 0 || depth < 0 {
+		return -1
+	}
+
+	needed := depth / policy.MessagesPerInstance
+	if depth%policy.MessagesPerInstance != 0 {
+		needed += 1
+	}
+	return bound(needed, policy.MinInstances, policy.MaxInstances)
+}
+
+/* The queue a consumer is scaled from, either named in the policy or the first queue it does not produce to */
+func QueueName(app *model.ApplicationConfiguration) string {
+	if app.QueueAutoscale.Queue != "" {
+		return app.QueueAutoscale.Queue
+	}
+
+	config := app.GetLatestPublishedConfiguration()
+	if config == nil {
+		return ""
+	}
+
+	for _, queue := range config.DataQueue {
+		if !queue.Producer {
+			return queue.Name
+		}
+	}
+	return ""
+}
+
+func bound(value int, min int, max int) int {
+	if max > 0 && value > max {
+		value = max
+	}
+
+	if value < min {
+		value = min
+	}
+	return value
+}
+
+func (scaler *Scaler) ObserveQueue(name string, depth int, now time.Time) {
+	scaler.queueLock.Lock()
+	defer scaler.queueLock.Unlock()
+
+	observation := scaler.queues[name]
+	if depth > 0 {
+		observation.EmptySince = time.Time{}
+	} else if observation.EmptySince.IsZero() {
+		observation.EmptySince = now
+	}
+	observation.Depth = depth
+	observation.Time = now
+	scaler.queues[name] = observation
+}
+
+func (scaler *Scaler) recommendFromQueue(app *model.ApplicationConfiguration, now time.Time) (int, string) {
+	name := QueueName(app)
+
+	scaler.queueLock.Lock()
+	observation, ok := scaler.queues[name]
+	scaler.queueLock.Unlock()
+
+	if !ok || now.Sub(observation.Time) > QUEUE_OBSERVATION_TTL {
+		return -1, ""
+	}
+
+	policy := app.QueueAutoscale
+	if observation.Depth == 0 && policy.ScaleToZeroAfter > 0 && now.Sub(observation.EmptySince) >= time.Duration(policy.ScaleToZeroAfter)*time.Second {
+		return 0, fmt.Sprintf("queue %s has been empty since %s", name, observation.EmptySince.Format(time.RFC3339))
+	}
+
+	return RecommendFromQueue(policy, observation.Depth), fmt.Sprintf("queue %s has %d messages at %d per instance", name, observation.Depth, policy.MessagesPerInstance)
+}
+
+/* When both policies are enabled the larger recommendation and the longer cooldowns win */
+func (scaler *Scaler) recommend(app *model.ApplicationConfiguration, samples []state.ApplicationUtilisationStatistic, now time.Time) (int, string) {
+	raw := -1
+	reasons := make([]string, 0)
+
+	if app.Autoscale.Enabled {
+		metric := Recommend(app.Autoscale, samples)
+		if metric >= 0 {
+			raw = metric
+			reasons = append(reasons, fmt.Sprintf("%s usage needs %d instances at %d per instance", app.Autoscale.Metric, metric, app.Autoscale.Target))
+		}
+	}
+
+	if app.QueueAutoscale.Enabled {
+		queue, reason := scaler.recommendFromQueue(app, now)
+		if queue >= 0 {
+			if queue > raw {
+				raw = queue
+			}
+			reasons = append(reasons, reason)
+		}
+	}
+
+	return raw, strings.Join(reasons, ", ")
+}
+
+func cooldowns(app *model.ApplicationConfiguration) (int64, int64) {
+	var up, down int64
+	if app.Autoscale.Enabled {
+		up = app.Autoscale.ScaleUpCooldown
+		down = app.Autoscale.ScaleDownCooldown
+	}
+
+	if app.QueueAutoscale.Enabled {
+		if app.QueueAutoscale.ScaleUpCooldown > up {
+			up = app.QueueAutoscale.ScaleUpCooldown
+		}
+		if app.QueueAutoscale.ScaleDownCooldown > down {
+			down = app.QueueAutoscale.ScaleDownCooldown
+		}
+	}
+	return up, down
+}
+
+/*
+	Works out the new DesiredDeployment for an app given the latest metrics and queue depth.
+	Scaling up uses the lowest recommendation inside the up window and scaling down the highest inside the down window,
+	so a single spike or dip does not move us. The floor always wins over cooldowns.
+*/
+func (scaler *Scaler) Evaluate(app *model.ApplicationConfiguration, samples []state.ApplicationUtilisationStatistic, floor int, now time.Time) (int, string) {
+	current := app.DesiredDeployment
+
+	raw, reason := scaler.recommend(app, samples, now)
+	if raw < 0 {
+		if current < floor {
+			return app.CapDeployment(floor), "nothing to scale from"
+		}
+		return app.CapDeployment(current), "nothing to scale from"
+	}
+
+	policy := app.Autoscale
+	history := append(scaler.history[app.Name], recommendation{Time: now, Value: raw})
+	keep := policy.ScaleUpStabilisationWindow
+	if policy.ScaleDownStabilisationWindow > keep {
+		keep = policy.ScaleDownStabilisationWindow
+	}
+	pruned := make([]recommendation, 0)
+	for _, entry := range history {
+		if now.Sub(entry.Time) < time.Duration(keep)*time.Second {
+			pruned = append(pruned, entry)
+		}
+	}
+	scaler.history[app.Name] = pruned
+
+	upValue := raw
+	downValue := raw
+	for _, entry := range pruned {
+		age := now.Sub(entry.Time)
+		if age < time.Duration(policy.ScaleUpStabilisationWindow)*time.Second && entry.Value < upValue {
+			upValue = entry.Value
+		}
+		if age < time.Duration(policy.ScaleDownStabilisationWindow)*time.Second && entry.Value > downValue {
+			downValue = entry.Value
+		}
+	}
+
+	upCooldown, downCooldown := cooldowns(app)
+	target := current
+	if upValue > current {
+		if now.Sub(scaler.lastScaleUp[app.Name]) < time.Duration(upCooldown)*time.Second {
+			reason += ", scale up is cooling down"
+		} else {
+			target = upValue
+		}
+	} else if downValue < current {
+		lastScale := scaler.lastScaleDown[app.Name]
+		if scaler.lastScaleUp[app.Name].After(lastScale) {
+			lastScale = scaler.lastScaleUp[app.Name]
+		}
+
+		if now.Sub(lastScale) < time.Duration(downCooldown)*time.Second {
+			reason += ", scale down is cooling down"
+		} else {
+			target = downValue
+		}
+	}
+
+	if target < floor {
+		target = floor
+	}
+
+	/* MaxDeployment beats both the floor and the metrics */
+	if app.CapDeployment(target) < target {
+		target = app.CapDeployment(target)
+		reason += fmt.Sprintf(", capped at max deployment %d", app.MaxDeployment)
+	}
+
+	if target > current {
+		scaler.lastScaleUp[app.Name] = now
+	} else if target < current {
+		scaler.lastScaleDown[app.Name] = now
+	}
+
+	return target, reason
+}
+
+func (scaler *Scaler) Run(configurationStore *configuration.ConfigurationStore) {
+	now := time.Now()
+	for _, app := range configurationStore.GetAllConfiguration() {
+		if !app.Enabled || !app.IsAutoscaled() {
+			continue
+		}
+
+		samples := []state.ApplicationUtilisationStatistic{}
+		if app.Autoscale.Enabled {
+			samples = state.Stats.Query__ApplicationUtilisationStatisticSince(app.Name, now.Add(-METRIC_WINDOW))
+		}
+		floor := configurationStore.ScheduledDesired(app, now)
+
+		desired, reason := scaler.Evaluate(app, samples, floor, now)
+		if desired == app.DesiredDeployment {
+			continue
+		}
+
+		state.Audit.Insert__AuditEvent(state.AuditEvent{Severity: state.AUDIT__INFO,
+			Message: fmt.Sprintf("AUTOSCALE: Application %s desired deployment changed from %d to %d (%s, floor %d)", app.Name, app.DesiredDeployment, desired, reason, floor),
+			AppId:   app.Name,
+		})
+		app.DesiredDeployment = desired
+	}
+}
@@ -0,0 +1,282 @@
+package scaling
+
+import (
+	"orca/trainer/model"
+	"orca/trainer/state"
+	"testing"
+	"time"
+)
+
+func cpuSamples(values ...int64) []state.ApplicationUtilisationStatistic {
+	ret := make([]state.ApplicationUtilisationStatistic, 0)
+	for _, value := range values {
+		ret = append(ret, state.ApplicationUtilisationStatistic{Cpu: value})
+	}
+	return ret
+}
+
+func testApp(desired int) *model.ApplicationConfiguration {
+	return &model.ApplicationConfiguration{
+		Name:              "app1",
+		MinDeployment:     1,
+		DesiredDeployment: desired,
+		Enabled:           true,
+		Autoscale: model.AutoscalePolicy{
+			Enabled:      true,
+			Metric:       model.AUTOSCALE__CPU,
+			Target:       50,
+			MinInstances: 1,
+			MaxInstances: 10,
+		},
+	}
+}
+
+func TestScaling_Recommend(t *testing.T) {
+	policy := model.AutoscalePolicy{Metric: model.AUTOSCALE__CPU, Target: 50}
+	if Recommend(policy, cpuSamples(100, 200)) != 3 {
+		t.Errorf("%d", Recommend(policy, cpuSamples(100, 200)))
+	}
+
+	if Recommend(policy, cpuSamples()) != -1 {
+		t.Fail()
+	}
+
+	policy.Metric = model.AUTOSCALE__MEMORY
+	if Recommend(policy, []state.ApplicationUtilisationStatistic{{Cpu: 1000, Mbytes: 100}}) != 2 {
+		t.Fail()
+	}
+}
+
+func TestScaling_ClampedToFloorAndMax(t *testing.T) {
+	scaler := Scaler{}
+	scaler.Init()
+	now := time.Now()
+
+	app := testApp(2)
+	if desired, _ := scaler.Evaluate(app, cpuSamples(5000), 0, now); desired != 10 {
+		t.Errorf("%d", desired)
+	}
+
+	/* The schedule asks for 4, metrics only need 1 */
+	app = testApp(4)
+	scaler.Init()
+	if desired, _ := scaler.Evaluate(app, cpuSamples(10), 4, now); desired != 4 {
+		t.Errorf("%d", desired)
+	}
+
+	/* No metrics, but the floor still applies */
+	app = testApp(1)
+	if desired, _ := scaler.Evaluate(app, cpuSamples(), 3, now); desired != 3 {
+		t.Errorf("%d", desired)
+	}
+}
+
+func TestScaling_Cooldowns(t *testing.T) {
+	scaler := Scaler{}
+	scaler.Init()
+	now := time.Now()
+
+	app := testApp(2)
+	app.Autoscale.ScaleUpCooldown = 300
+	app.Autoscale.ScaleDownCooldown = 600
+
+	desired, _ := scaler.Evaluate(app, cpuSamples(200), 1, now)
+	if desired != 4 {
+		t.Errorf("%d", desired)
+	}
+	app.DesiredDeployment = desired
+
+	/* Still cooling down from the last scale up */
+	if desired, _ := scaler.Evaluate(app, cpuSamples(300), 1, now.Add(time.Minute)); desired != 4 {
+		t.Errorf("%d", desired)
+	}
+
+	if desired, _ := scaler.Evaluate(app, cpuSamples(300), 1, now.Add(time.Minute*6)); desired != 6 {
+		t.Errorf("%d", desired)
+	}
+	app.DesiredDeployment = 6
+
+	/* Scale down waits for the down cooldown measured from the last scale up */
+	if desired, _ := scaler.Evaluate(app, cpuSamples(50), 1, now.Add(time.Minute*10)); desired != 6 {
+		t.Errorf("%d", desired)
+	}
+
+	if desired, _ := scaler.Evaluate(app, cpuSamples(50), 1, now.Add(time.Minute*17)); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+}
+
+func TestScaling_StabilisationWindow(t *testing.T) {
+	scaler := Scaler{}
+	scaler.Init()
+	now := time.Now()
+
+	app := testApp(4)
+	app.Autoscale.ScaleDownStabilisationWindow = 300
+
+	/* A short dip inside the window does not scale down */
+	if desired, _ := scaler.Evaluate(app, cpuSamples(200), 1, now); desired != 4 {
+		t.Errorf("%d", desired)
+	}
+
+	if desired, _ := scaler.Evaluate(app, cpuSamples(50), 1, now.Add(time.Minute*2)); desired != 4 {
+		t.Errorf("%d", desired)
+	}
+
+	/* Once the high recommendation falls out of the window we follow the metrics down */
+	if desired, _ := scaler.Evaluate(app, cpuSamples(50), 1, now.Add(time.Minute*6)); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+}
+
+func queueApp(desired int) *model.ApplicationConfiguration {
+	versions := make(map[string]*model.VersionConfig)
+	versions["1"] = &model.VersionConfig{
+		Version: "1",
+		DataQueue: []model.DataQueue{
+			{Name: "results", Producer: true},
+			{Name: "work"},
+		},
+	}
+
+	return &model.ApplicationConfiguration{
+		Name:              "worker",
+		DesiredDeployment: desired,
+		Enabled:           true,
+		PublishedConfig:   versions,
+		QueueAutoscale: model.QueueAutoscalePolicy{
+			Enabled:             true,
+			MessagesPerInstance: 100,
+			MinInstances:        1,
+			MaxInstances:        5,
+			ScaleToZeroAfter:    600,
+		},
+	}
+}
+
+func TestScaling_QueueDepth(t *testing.T) {
+	scaler := Scaler{}
+	scaler.Init()
+	now := time.Now()
+
+	app := queueApp(1)
+	if QueueName(app) != "work" {
+		t.Errorf("%s", QueueName(app))
+	}
+
+	/* Nothing observed yet */
+	if desired, _ := scaler.Evaluate(app, nil, 0, now); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+
+	scaler.ObserveQueue("work", 250, now)
+	if desired, _ := scaler.Evaluate(app, nil, 0, now); desired != 3 {
+		t.Errorf("%d", desired)
+	}
+
+	scaler.ObserveQueue("work", 100000, now)
+	if desired, _ := scaler.Evaluate(app, nil, 0, now); desired != 5 {
+		t.Errorf("%d", desired)
+	}
+
+	/* Stale observations are ignored */
+	if desired, _ := scaler.Evaluate(app, nil, 0, now.Add(time.Minute*5)); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+}
+
+func TestScaling_QueueScaleToZero(t *testing.T) {
+	scaler := Scaler{}
+	scaler.Init()
+	now := time.Now()
+
+	app := queueApp(2)
+	scaler.ObserveQueue("work", 0, now)
+	if desired, _ := scaler.Evaluate(app, nil, 0, now); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+	app.DesiredDeployment = 1
+
+	/* A message arriving resets the empty timer */
+	scaler.ObserveQueue("work", 10, now.Add(time.Minute*5))
+	scaler.ObserveQueue("work", 0, now.Add(time.Minute*6))
+	if desired, _ := scaler.Evaluate(app, nil, 0, now.Add(time.Minute*12)); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+
+	scaler.ObserveQueue("work", 0, now.Add(time.Minute*16))
+	if desired, _ := scaler.Evaluate(app, nil, 0, now.Add(time.Minute*16)); desired != 0 {
+		t.Errorf("%d", desired)
+	}
+
+	/* The schedule floor still wins */
+	app.DesiredDeployment = 1
+	if desired, _ := scaler.Evaluate(app, nil, 1, now.Add(time.Minute*16)); desired != 1 {
+		t.Errorf("%d", desired)
+	}
+}
+
+func TestScaling_CappedAtMaxDeployment(t *testing.T) {
+	scaler := Scaler{}
+	scaler.Init()
+	now := time.Now()
+
+	app := testApp(2)
+	app.MaxDeployment = 4
+	if desired, _ := scaler.Evaluate(app, cpuSamples(5000), 0, now); desired != 4 {
+		t.Errorf("%d", desired)
+	}
+
+	/* Even the schedule floor cannot go past the max */
+	app = testApp(2)
+	app.MaxDeployment = 3
+	scaler.Init()
+	if desired, _ := scaler.Evaluate(app, cpuSamples(), 500, now); desired != 3 {
+		t.Errorf("%d", desired)
+	}
+}
+
+func TestScaling_ValidateDeploymentLimits(t *testing.T) {
+	app := testApp(2)
+	app.Autoscale.MaxInstances = 5
+	app.MaxDeployment = 5
+	if err := app.ValidateDeploymentLimits(); err != nil {
+		t.Error(err)
+	}
+
+	app.DeploymentSchedule.SetAll(500)
+	if err := app.ValidateDeploymentLimits(); err == nil {
+		t.Fail()
+	}
+
+	app.DeploymentSchedule.SetAll(5)
+	app.Autoscale.MaxInstances = 10
+	if err := app.ValidateDeploymentLimits(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestScaling_LeadTime(t *testing.T) {
+	app := testApp(2)
+	app.PreScale.LeadTime = 300
+	app.PreScale.LearnedLeadTime = 420
+	if app.LeadTime() != 5*time.Minute {
+		t.Error(app.LeadTime())
+	}
+
+	app.PreScale.Learn = true
+	if app.LeadTime() != 7*time.Minute {
+		t.Error(app.LeadTime())
+	}
+
+	/* Nothing learned yet, fall back to the fixed lead time */
+	app.PreScale.LearnedLeadTime = 0
+	if app.LeadTime() != 5*time.Minute {
+		t.Error(app.LeadTime())
+	}
+
+	app.PreScale.LearnedLeadTime = 86400
+	if app.LeadTime() != model.MAX_LEARNED_LEAD_TIME {
+		t.Error(app.LeadTime())
+	}
+}
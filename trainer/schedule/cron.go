@@ -0,0 +1,270 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	A rule is active for every minute its expression matches, so a window is written with ranges,
+	"* 9-17 * * 1-5" is office hours on weekdays. Fields are minute, hour, day of month, month and
+	day of week, and take lists, ranges and steps as in crontab.
+*/
+type CronRule struct {
+	Expression string
+	Desired    int
+}
+
+/* Overrides everything else from Start up to but not including End */
+type DateException struct {
+	Name    string
+	Start   time.Time
+	End     time.Time
+	Desired int
+}
+
+type cronField struct {
+	values []bool
+	any    bool
+}
+
+type cronSpec struct {
+	minute     cronField
+	hour       cronField
+	dayOfMonth cronField
+	month      cronField
+	dayOfWeek  cronField
+}
+
+/* As in crontab, a field starting with a star counts as unrestricted when the two day fields are combined, steps or not */
+func parseCronField(field string, min int, max int) (cronField, error) {
+	ret := cronField{values: make([]bool, max+1), any: strings.HasPrefix(field, "*")}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return ret, fmt.Errorf("bad step in %s", part)
+			}
+			part = part[:idx]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return ret, fmt.Errorf("bad value %s", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return ret, fmt.Errorf("bad range %s", part)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return ret, fmt.Errorf("%s is outside %d-%d", part, min, max)
+		}
+
+		for i := low; i <= high; i += step {
+			ret.values[i] = true
+		}
+	}
+	return ret, nil
+}
+
+func parseCron(expression string) (*cronSpec, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron expression " + expression + " needs 5 fields")
+	}
+
+	spec := &cronSpec{}
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, errors.New("Cron expression " + expression + ": " + err.Error())
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, errors.New("Cron expression " + expression + ": " + err.Error())
+	}
+	if spec.dayOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, errors.New("Cron expression " + expression + ": " + err.Error())
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, errors.New("Cron expression " + expression + ": " + err.Error())
+	}
+	/* 7 is Sunday as well as 0 */
+	if spec.dayOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, errors.New("Cron expression " + expression + ": " + err.Error())
+	}
+	if spec.dayOfWeek.values[7] {
+		spec.dayOfWeek.values[0] = true
+	}
+	return spec, nil
+}
+
+/* As in crontab, when both day fields are restricted either one matching is enough */
+func (spec *cronSpec) matches(t time.Time) bool {
+	if !spec.minute.values[t.Minute()] || !spec.hour.values[t.Hour()] || !spec.month.values[int(t.Month())] {
+		return false
+	}
+
+	dayOfMonth := spec.dayOfMonth.values[t.Day()]
+	dayOfWeek := spec.dayOfWeek.values[int(t.Weekday())]
+	if !spec.dayOfMonth.any && !spec.dayOfWeek.any {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+/* How far ahead NextOpen looks for a window */
+const MAINTENANCE_LOOKAHEAD = 31 * 24 * time.Hour
+
+/*
+	Windows are cron expressions in Timezone, open for every minute one of them matches.
+	No windows at all means always open.
+*/
+type MaintenanceWindows struct {
+	Timezone string
+	Windows  []string
+}
+
+func (m MaintenanceWindows) IsEmpty() bool {
+	return len(m.Windows) == 0
+}
+
+func (m MaintenanceWindows) location() *time.Location {
+	location, err := DeploymentSchedule{Timezone: m.Timezone}.Location()
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+func (m MaintenanceWindows) Validate() error {
+	if _, err := (DeploymentSchedule{Timezone: m.Timezone}).Location(); err != nil {
+		return errors.New("Unknown maintenance timezone " + m.Timezone)
+	}
+
+	for _, window := range m.Windows {
+		if _, err := parseCron(window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MaintenanceWindows) compile() []*cronSpec {
+	ret := make([]*cronSpec, 0)
+	for _, window := range m.Windows {
+		if spec, err := parseCron(window); err == nil {
+			ret = append(ret, spec)
+		}
+	}
+	return ret
+}
+
+func openAt(specs []*cronSpec, t time.Time) bool {
+	for _, spec := range specs {
+		if spec.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m MaintenanceWindows) IsOpen(t time.Time) bool {
+	if m.IsEmpty() {
+		return true
+	}
+	return openAt(m.compile(), t.In(m.location()))
+}
+
+/* The start of the next window after t, false if none opens within MAINTENANCE_LOOKAHEAD */
+func (m MaintenanceWindows) NextOpen(t time.Time) (time.Time, bool) {
+	if m.IsEmpty() {
+		return t, true
+	}
+
+	specs := m.compile()
+	location := m.location()
+	for next := t.Truncate(time.Minute).Add(time.Minute); next.Before(t.Add(MAINTENANCE_LOOKAHEAD)); next = next.Add(time.Minute) {
+		if openAt(specs, next.In(location)) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/* How far back Latest looks for firings a stopped trainer missed */
+const CRON_CATCHUP_LIMIT = 31 * 24 * time.Hour
+
+/* A cron expression in Timezone that fires at the minutes it matches, rather than holding a level like a CronRule */
+type CronTrigger struct {
+	Expression string
+	Timezone   string
+}
+
+func (c CronTrigger) Validate() error {
+	if _, err := (DeploymentSchedule{Timezone: c.Timezone}).Location(); err != nil {
+		return errors.New("Unknown cron timezone " + c.Timezone)
+	}
+
+	_, err := parseCron(c.Expression)
+	return err
+}
+
+/*
+	The latest firing in (after, now] and how many firings there were in that span.
+	False when there were none, or the expression does not parse.
+*/
+func (c CronTrigger) Latest(after time.Time, now time.Time) (time.Time, int, bool) {
+	spec, err := parseCron(c.Expression)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	location := (MaintenanceWindows{Timezone: c.Timezone}).location()
+	if earliest := now.Add(-CRON_CATCHUP_LIMIT); after.Before(earliest) {
+		after = earliest
+	}
+
+	latest := time.Time{}
+	count := 0
+	for next := after.Truncate(time.Minute).Add(time.Minute); !next.After(now); next = next.Add(time.Minute) {
+		if spec.matches(next.In(location)) {
+			latest = next
+			count += 1
+		}
+	}
+	return latest, count, count > 0
+}
@@ -18,7 +18,11 @@ along with Orca.  If not, see <http://www.gnu.org/licenses/>.
 
 package schedule
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 type DeploymentSchedule WeekdaySchedule
 
@@ -32,12 +36,248 @@ type DeploymentSchedulePart struct {
 }
 
 
+/* Where an effective desired count came from, in order of precedence */
+const (
+	SOURCE__EXCEPTION = "exception"
+	SOURCE__CRON      = "cron"
+	SOURCE__GRID      = "grid"
+)
+
+/* Upper bound on points rendered in one go */
+const MAX_RENDERED_POINTS = 20000
+
+type RenderedPoint struct {
+	Time    time.Time
+	Desired int
+	Source  string
+}
+
 func (w DeploymentSchedule) IsEmpty() bool {
-	return w.Schedule.isEmpty()
+	return w.Schedule.isEmpty() && len(w.Rules) == 0 && len(w.Exceptions) == 0
+}
+
+func (w DeploymentSchedule) resolution() int {
+	if w.Resolution <= 0 {
+		return MINUTES_DELTA
+	}
+	return w.Resolution
+}
+
+func (w DeploymentSchedule) Location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(w.Timezone)
+}
+
+func (w DeploymentSchedule) Validate() error {
+	if _, err := w.Location(); err != nil {
+		return errors.New("Unknown schedule timezone " + w.Timezone)
+	}
+
+	if w.Resolution < 0 || (w.Resolution > 0 && (24 * 60) % w.Resolution != 0) {
+		return fmt.Errorf("Schedule resolution %d does not divide a day", w.Resolution)
+	}
+
+	/* A grid saved at a coarser resolution has no value between its old slots, every one of them would read 0 */
+	resolution := w.resolution()
+	for day, slots := range w.Schedule {
+		if len(slots) == 0 {
+			continue
+		}
+
+		for minutes := range slots {
+			if minutes < 0 || minutes >= 24 * 60 || int(minutes) % resolution != 0 {
+				return fmt.Errorf("Schedule slot %d on %s is not on the %d minute resolution", minutes, day, resolution)
+			}
+		}
+
+		if len(slots) != (24 * 60) / resolution {
+			return fmt.Errorf("Schedule for %s has %d slots, a %d minute resolution needs %d", day, len(slots), resolution, (24 * 60) / resolution)
+		}
+	}
+
+	for _, rule := range w.Rules {
+		if _, err := parseCron(rule.Expression); err != nil {
+			return err
+		}
+	}
+
+	for _, exception := range w.Exceptions {
+		if !exception.End.After(exception.Start) {
+			return errors.New("Schedule exception " + exception.Name + " ends before it starts")
+		}
+	}
+	return nil
+}
+
+type compiledRule struct {
+	spec    *cronSpec
+	desired int
+}
+
+/* Rules that do not parse are skipped, Validate keeps them out of saved configuration */
+func (w DeploymentSchedule) compileRules() []compiledRule {
+	ret := make([]compiledRule, 0)
+	for _, rule := range w.Rules {
+		if spec, err := parseCron(rule.Expression); err == nil {
+			ret = append(ret, compiledRule{spec: spec, desired: rule.Desired})
+		}
+	}
+	return ret
+}
+
+/*
+	Dated exceptions win over cron rules, which win over the weekly grid.
+	When several exceptions or several rules apply at once the largest count is used.
+	Rules and the grid are looked up on the wall clock of the schedules timezone, so 9am stays 9am across DST changes.
+*/
+func (w DeploymentSchedule) evaluate(t time.Time, rules []compiledRule, location *time.Location) (int, string) {
+	found := false
+	max := 0
+	for _, exception := range w.Exceptions {
+		if !t.Before(exception.Start) && t.Before(exception.End) && (!found || exception.Desired > max) {
+			found = true
+			max = exception.Desired
+		}
+	}
+	if found {
+		return max, SOURCE__EXCEPTION
+	}
+
+	local := t.In(location)
+	for _, rule := range rules {
+		if rule.spec.matches(local) && (!found || rule.desired > max) {
+			found = true
+			max = rule.desired
+		}
+	}
+	if found {
+		return max, SOURCE__CRON
+	}
+
+	return w.Schedule.getAt(local, w.resolution()), SOURCE__GRID
+}
+
+func (w DeploymentSchedule) location() *time.Location {
+	location, err := w.Location()
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+func (w DeploymentSchedule) Get(t time.Time) int {
+	desired, _ := w.evaluate(t, w.compileRules(), w.location())
+	return desired
+}
+
+/* The effective desired count from from up to to, one point per step */
+func (w DeploymentSchedule) Render(from time.Time, to time.Time, step time.Duration) ([]RenderedPoint, error) {
+	if step <= 0 {
+		step = time.Duration(w.resolution()) * time.Minute
+	}
+
+	if !to.After(from) {
+		return nil, errors.New("Render range ends before it starts")
+	}
+
+	if int64(to.Sub(from) / step) >= MAX_RENDERED_POINTS {
+		return nil, fmt.Errorf("Render range needs more than %d points, use a larger step", MAX_RENDERED_POINTS)
+	}
+
+	rules := w.compileRules()
+	location := w.location()
+	ret := make([]RenderedPoint, 0)
+	for t := from; t.Before(to); t = t.Add(step) {
+		desired, source := w.evaluate(t, rules, location)
+		ret = append(ret, RenderedPoint{Time: t, Desired: desired, Source: source})
+	}
+	return ret, nil
+}
+
+/*
+	The largest count asked for at any point from from to to, checked every minute as that is as fine as rules get,
+	and at the start of every exception inside the range.
+*/
+func (w DeploymentSchedule) MaxBetween(from time.Time, to time.Time) int {
+	rules := w.compileRules()
+	location := w.location()
+
+	max, _ := w.evaluate(from, rules, location)
+	check := func(t time.Time) {
+		if desired, _ := w.evaluate(t, rules, location); desired > max {
+			max = desired
+		}
+	}
+
+	for t := from.Truncate(time.Minute).Add(time.Minute); t.Before(to); t = t.Add(time.Minute) {
+		check(t)
+	}
+
+	for _, exception := range w.Exceptions {
+		if exception.Start.After(from) && exception.Start.Before(to) {
+			check(exception.Start)
+		}
+	}
+
+	if to.After(from) {
+		check(to)
+	}
+	return max
 }
 
-func (w DeploymentSchedule) Get(time time.Time) int {
-	return w.Schedule.get(time)
+/* The schedule as UTC slots for the week starting at from, the mapping moves with DST so it is only good for that week */
+func (w DeploymentSchedule) UtcView(from time.Time) WeekdayBased {
+	view := make(WeekdayBased)
+	resolution := w.resolution()
+	start := from.UTC().Truncate(time.Duration(resolution) * time.Minute)
+	for i := 0; i < 7 * 24 * 60; i += resolution {
+		slot := start.Add(time.Duration(i) * time.Minute)
+		day, minutes := timeToWeekdayMinutesAt(slot, resolution)
+		view.set(day, minutes, w.Get(slot))
+	}
+	return view
+}
+
+/* The effective schedule as wall clock slots in the schedules timezone for the week starting at from, rules and exceptions included */
+func (w DeploymentSchedule) LocalView(from time.Time) WeekdayBased {
+	view := make(WeekdayBased)
+	resolution := w.resolution()
+	location := w.location()
+	local := from.In(location)
+	for day := 0; day < 7; day++ {
+		for minutes := 0; minutes < 24 * 60; minutes += resolution {
+			slot := time.Date(local.Year(), local.Month(), local.Day() + day, 0, minutes, 0, 0, location)
+			view.set(slot.Weekday(), Minutes(minutes), w.Get(slot))
+		}
+	}
+	return view
+}
+
+/* The largest deployment asked for by any part of the schedule */
+func (w DeploymentSchedule) Max() int {
+	max := 0
+	for _, day := range w.Schedule {
+		for _, val := range day {
+			if val > max {
+				max = val
+			}
+		}
+	}
+
+	for _, rule := range w.Rules {
+		if rule.Desired > max {
+			max = rule.Desired
+		}
+	}
+
+	for _, exception := range w.Exceptions {
+		if exception.Desired > max {
+			max = exception.Desired
+		}
+	}
+	return max
 }
 
 func (w *DeploymentSchedule) Set(day time.Weekday, minutes Minutes, ns int) {
@@ -51,5 +291,5 @@ func (w *DeploymentSchedule) SetAll(ns int) {
 	if len(w.Schedule) == 0 {
 		w.Schedule = make(map[time.Weekday]map[Minutes]int)
 	}
-	w.Schedule.setAll(ns)
+	w.Schedule.setAllAt(ns, w.resolution())
 }
@@ -0,0 +1,102 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package schedule
+
+import (
+	"fmt"
+	"time"
+)
+
+const MINUTES_PER_WEEK = 7 * 24 * 60
+
+/*
+	Parts are the source of truth for the weekly grid when an app has any.
+	A part starts at StartDay (Sunday is 0) and StartMinute, and runs for Days days plus Minutes minutes,
+	wrapping from Saturday into Sunday. Where parts overlap the largest Desired wins, slots no part covers are 0.
+*/
+func (part DeploymentSchedulePart) duration() int {
+	return part.Days * 24 * 60 + part.Minutes
+}
+
+func (part DeploymentSchedulePart) Validate(resolution int) error {
+	if part.StartDay < 0 || part.StartDay > 6 {
+		return fmt.Errorf("Schedule part %d starts on day %d, days run from 0 (Sunday) to 6", part.Id, part.StartDay)
+	}
+
+	if part.StartMinute < 0 || part.StartMinute >= 24 * 60 {
+		return fmt.Errorf("Schedule part %d starts at minute %d, which is not in a day", part.Id, part.StartMinute)
+	}
+
+	if part.Days < 0 || part.Minutes < 0 || part.duration() <= 0 {
+		return fmt.Errorf("Schedule part %d has no length", part.Id)
+	}
+
+	if part.duration() > MINUTES_PER_WEEK {
+		return fmt.Errorf("Schedule part %d is longer than a week", part.Id)
+	}
+
+	if part.StartMinute % resolution != 0 || part.duration() % resolution != 0 {
+		return fmt.Errorf("Schedule part %d does not line up with the %d minute resolution", part.Id, resolution)
+	}
+
+	if part.Desired < 0 {
+		return fmt.Errorf("Schedule part %d has a negative desired count", part.Id)
+	}
+	return nil
+}
+
+func ValidateParts(parts []DeploymentSchedulePart, resolution int) error {
+	ids := make(map[int]bool)
+	for _, part := range parts {
+		if ids[part.Id] {
+			return fmt.Errorf("Schedule part id %d is used twice", part.Id)
+		}
+		ids[part.Id] = true
+
+		if err := part.Validate(resolution); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Replaces the weekly grid with one built from the parts */
+func (w *DeploymentSchedule) CompileParts(parts []DeploymentSchedulePart) error {
+	resolution := w.resolution()
+	if err := ValidateParts(parts, resolution); err != nil {
+		return err
+	}
+
+	grid := make(WeekdayBased)
+	grid.setAllAt(0, resolution)
+	for _, part := range parts {
+		start := part.StartDay * 24 * 60 + part.StartMinute
+		for offset := 0; offset < part.duration(); offset += resolution {
+			slot := (start + offset) % MINUTES_PER_WEEK
+			day := time.Weekday(slot / (24 * 60))
+			minutes := Minutes(slot % (24 * 60))
+			if part.Desired > grid[day][minutes] {
+				grid.set(day, minutes, part.Desired)
+			}
+		}
+	}
+
+	w.Schedule = grid
+	return nil
+}
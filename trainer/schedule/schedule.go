@@ -30,6 +30,13 @@ const (
 
 type WeekdaySchedule struct {
 	Schedule WeekdayBased
+	Timezone string /* IANA name such as Europe/London, the slots are wall clock times there. Empty means UTC */
+
+	/* Minutes per grid slot, must divide a day. Zero means MINUTES_DELTA */
+	Resolution int
+
+	Rules      []CronRule
+	Exceptions []DateException
 }
 
 type Minutes int
@@ -37,9 +44,13 @@ type Minutes int
 type WeekdayBased map[time.Weekday]map[Minutes]int
 
 func (w WeekdayBased) get(t time.Time) int {
-	day, minutes := timeToWeekdayMinutes(t)
+	return w.getAt(t, MINUTES_DELTA)
+}
+
+func (w WeekdayBased) getAt(t time.Time, resolution int) int {
+	day, minutes := timeToWeekdayMinutesAt(t, resolution)
 	var max int
-	for i := (minutes - CAUTION_INTERVAL * MINUTES_DELTA); i <= minutes + CAUTION_INTERVAL * MINUTES_DELTA; i += MINUTES_DELTA {
+	for i := (minutes - Minutes(CAUTION_INTERVAL * resolution)); i <= minutes + Minutes(CAUTION_INTERVAL * resolution); i += Minutes(resolution) {
 		if i >= 0 && i < 1440 {
 			current := w[day][Minutes(i)]
 			if current > max {
@@ -80,9 +91,13 @@ func (w WeekdayBased) set(day time.Weekday, minutes Minutes, val int) {
 }
 
 func (w WeekdayBased) setAll(val int) {
+	w.setAllAt(val, MINUTES_DELTA)
+}
+
+func (w WeekdayBased) setAllAt(val int, resolution int) {
 	for i := 0; i < 7; i++ {
 		w[time.Weekday(i)] = make(map[Minutes]int)
-		for m := 0; m < (24 * 60); m += MINUTES_DELTA {
+		for m := 0; m < (24 * 60); m += resolution {
 			w[time.Weekday(i)][Minutes(m)] = val
 		}
 	}
@@ -93,8 +108,8 @@ func (w WeekdayBased) isEmpty() bool {
 		return true
 	}
 	for i := 0; i < 7; i++ {
-		for m := 0; m < (24 * 60); m += MINUTES_DELTA {
-			if w[time.Weekday(i)][Minutes(m)] != 0 {
+		for _, val := range w[time.Weekday(i)] {
+			if val != 0 {
 				return false
 			}
 		}
@@ -102,13 +117,16 @@ func (w WeekdayBased) isEmpty() bool {
 	return true
 }
 
-//get weekday and minutes in MINUTES_DELTA increments. always rounded down
+//get weekday and minutes in MINUTES_DELTA increments, in the timezone t is in. always rounded down
 func timeToWeekdayMinutes(t time.Time) (time.Weekday, Minutes) {
-	utcTime := t.UTC()
-	w := utcTime.Weekday()
-	m := utcTime.Hour() * 60 + utcTime.Minute()
-	if m % MINUTES_DELTA != 0 {
-		m = int(m / MINUTES_DELTA) * MINUTES_DELTA
+	return timeToWeekdayMinutesAt(t, MINUTES_DELTA)
+}
+
+func timeToWeekdayMinutesAt(t time.Time, resolution int) (time.Weekday, Minutes) {
+	w := t.Weekday()
+	m := t.Hour() * 60 + t.Minute()
+	if m % resolution != 0 {
+		m = int(m / resolution) * resolution
 	}
 	return w, Minutes(m)
 }
@@ -177,3 +177,277 @@ func TestGenerateSchedule (t *testing.T){
 	fmt.Printf("%s", result)
 
 }
+
+func TestTimezoneFollowsDaylightSaving(t *testing.T) {
+	schedule := DeploymentSchedule{}
+	schedule.Timezone = "Europe/London"
+	schedule.SetAll(1)
+	schedule.Set(time.Monday, Minutes(540), 10)
+
+	// GMT, local matches UTC
+	t1, _ := time.Parse(time.RFC3339Nano, "2017-03-20T09:15:00+00:00")
+	if schedule.Get(t1) != 10 {
+		t.Error(schedule.Get(t1))
+	}
+
+	// BST started on the 26th, 9am local is now 8am UTC
+	t2, _ := time.Parse(time.RFC3339Nano, "2017-03-27T08:15:00+00:00")
+	if schedule.Get(t2) != 10 {
+		t.Error(schedule.Get(t2))
+	}
+	t3, _ := time.Parse(time.RFC3339Nano, "2017-03-27T09:15:00+00:00")
+	if schedule.Get(t3) != 1 {
+		t.Error(schedule.Get(t3))
+	}
+
+	view := schedule.UtcView(t2)
+	if view[time.Monday][Minutes(480)] != 10 || view[time.Monday][Minutes(540)] != 1 {
+		t.Error(view[time.Monday])
+	}
+
+	// The local view stays on the wall clock grid
+	localView := schedule.LocalView(t2)
+	if localView[time.Monday][Minutes(540)] != 10 || localView[time.Monday][Minutes(480)] != 1 {
+		t.Error(localView[time.Monday])
+	}
+
+	schedule.Timezone = "Not/AZone"
+	if _, err := schedule.Location(); err == nil {
+		t.Fail()
+	}
+	if schedule.Get(t1) != 10 {
+		t.Error(schedule.Get(t1))
+	}
+}
+
+func TestCronRulesAndExceptions(t *testing.T) {
+	schedule := DeploymentSchedule{}
+	schedule.Resolution = 5
+	schedule.SetAll(2)
+	schedule.Set(time.Wednesday, Minutes(545), 3)
+	schedule.Rules = []CronRule{
+		{Expression: "* 9-17 * * 1-5", Desired: 10},
+		{Expression: "30-44 12 * * 3", Desired: 20},
+	}
+
+	black, _ := time.Parse(time.RFC3339, "2017-11-24T00:00:00Z")
+	schedule.Exceptions = []DateException{{Name: "black friday", Start: black, End: black.Add(24 * time.Hour), Desired: 50}}
+
+	if err := schedule.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// 5 minute grid slot, outside the rules
+	t1, _ := time.Parse(time.RFC3339, "2017-11-22T09:06:00Z")
+	if schedule.Get(t1) != 10 {
+		t.Error(schedule.Get(t1))
+	}
+	t2, _ := time.Parse(time.RFC3339, "2017-11-22T18:06:00Z")
+	if schedule.Get(t2) != 2 {
+		t.Error(schedule.Get(t2))
+	}
+
+	// Overlapping rules take the larger count
+	t3, _ := time.Parse(time.RFC3339, "2017-11-22T12:31:00Z")
+	if schedule.Get(t3) != 20 {
+		t.Error(schedule.Get(t3))
+	}
+
+	// The exception beats the weekday rule
+	t4, _ := time.Parse(time.RFC3339, "2017-11-24T10:00:00Z")
+	if schedule.Get(t4) != 50 {
+		t.Error(schedule.Get(t4))
+	}
+
+	view := schedule.LocalView(t1)
+	if view[time.Wednesday][Minutes(750)] != 20 || view[time.Wednesday][Minutes(1080)] != 2 || view[time.Friday][Minutes(1200)] != 50 {
+		t.Error(view[time.Wednesday][Minutes(750)], view[time.Wednesday][Minutes(1080)], view[time.Friday][Minutes(1200)])
+	}
+
+	points, err := schedule.Render(t3, t3.Add(30 * time.Minute), 0)
+	if err != nil || len(points) != 6 || points[0].Source != SOURCE__CRON || points[0].Desired != 20 || points[5].Desired != 10 {
+		t.Error(points, err)
+	}
+
+	schedule.Rules = append(schedule.Rules, CronRule{Expression: "61 * * * *"})
+	if schedule.Validate() == nil {
+		t.Fail()
+	}
+}
+
+func TestCronStepDayFieldIsUnrestricted(t *testing.T) {
+	spec, err := parseCron("0 9 */2 * 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Both day fields have to match, a star with a step does not switch to either one */
+	for expression, expected := range map[string]bool{
+		"2017-11-13T09:00:00Z": true,
+		"2017-11-20T09:00:00Z": false,
+		"2017-11-15T09:00:00Z": false,
+	} {
+		at, _ := time.Parse(time.RFC3339, expression)
+		if spec.matches(at) != expected {
+			t.Error(expression)
+		}
+	}
+}
+
+func TestGridMustMatchResolution(t *testing.T) {
+	schedule := DeploymentSchedule{}
+	schedule.SetAll(3)
+	if err := schedule.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	/* An hourly grid read every 5 minutes would be 0 for 11 of every 12 slots */
+	schedule.Resolution = 5
+	if schedule.Validate() == nil {
+		t.Error("hourly grid accepted at a 5 minute resolution")
+	}
+
+	schedule.Schedule = nil
+	schedule.SetAll(3)
+	if err := schedule.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	schedule.Set(time.Monday, Minutes(547), 4)
+	if schedule.Validate() == nil {
+		t.Error("slot off the resolution accepted")
+	}
+}
+
+func TestCompileParts(t *testing.T) {
+	schedule := DeploymentSchedule{}
+	schedule.SetAll(100)
+
+	parts := []DeploymentSchedulePart{
+		// Weekdays 9 to 5
+		{Id: 1, StartDay: 1, StartMinute: 540, Days: 4, Minutes: 480, Desired: 5},
+		// Overlaps Monday afternoon
+		{Id: 2, StartDay: 1, StartMinute: 720, Minutes: 120, Desired: 8},
+		// Saturday 10pm into Sunday 2am
+		{Id: 3, StartDay: 6, StartMinute: 1320, Minutes: 240, Desired: 3},
+	}
+	if err := schedule.CompileParts(parts); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(day time.Weekday, minutes Minutes, expected int) {
+		if schedule.Schedule[day][minutes] != expected {
+			t.Error(day, minutes, schedule.Schedule[day][minutes])
+		}
+	}
+	check(time.Monday, 480, 0)
+	check(time.Monday, 540, 5)
+	check(time.Monday, 720, 8)
+	check(time.Monday, 840, 5)
+	// Days: 4 plus 480 minutes runs on to Friday 5pm
+	check(time.Friday, 960, 5)
+	check(time.Friday, 1020, 0)
+	check(time.Saturday, 1380, 3)
+	check(time.Sunday, 60, 3)
+	check(time.Sunday, 120, 0)
+
+	bad := [][]DeploymentSchedulePart{
+		{{Id: 1, StartDay: 7, Minutes: 60}},
+		{{Id: 1, StartDay: 1, StartMinute: 30, Minutes: 60}},
+		{{Id: 1, StartDay: 1}},
+		{{Id: 1, StartDay: 1, Minutes: 60}, {Id: 1, StartDay: 2, Minutes: 60}},
+	}
+	for _, parts := range bad {
+		if schedule.CompileParts(parts) == nil {
+			t.Error(parts)
+		}
+	}
+}
+
+func TestMaxBetweenBringsIncreasesForward(t *testing.T) {
+	schedule := DeploymentSchedule{}
+	schedule.SetAll(2)
+	schedule.Set(time.Wednesday, Minutes(540), 10)
+
+	t1, _ := time.Parse(time.RFC3339, "2017-02-22T08:45:00Z")
+	if schedule.MaxBetween(t1, t1) != 2 {
+		t.Error(schedule.MaxBetween(t1, t1))
+	}
+	if schedule.MaxBetween(t1, t1.Add(20 * time.Minute)) != 10 {
+		t.Error(schedule.MaxBetween(t1, t1.Add(20 * time.Minute)))
+	}
+
+	// Scale downs are not brought forward, at 10am we drop straight away
+	t2, _ := time.Parse(time.RFC3339, "2017-02-22T10:00:00Z")
+	if schedule.MaxBetween(t2, t2.Add(20 * time.Minute)) != 2 {
+		t.Error(schedule.MaxBetween(t2, t2.Add(20 * time.Minute)))
+	}
+	t3, _ := time.Parse(time.RFC3339, "2017-02-22T09:50:00Z")
+	if schedule.MaxBetween(t3, t3.Add(20 * time.Minute)) != 10 {
+		t.Error(schedule.MaxBetween(t3, t3.Add(20 * time.Minute)))
+	}
+
+	// An exception starting part way through a minute is still seen
+	schedule.Exceptions = []DateException{{Name: "launch", Start: t2.Add(90 * time.Second), End: t2.Add(time.Hour), Desired: 40}}
+	if schedule.MaxBetween(t2, t2.Add(100 * time.Second)) != 40 {
+		t.Error(schedule.MaxBetween(t2, t2.Add(100 * time.Second)))
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	windows := MaintenanceWindows{}
+	now, _ := time.Parse(time.RFC3339, "2017-02-22T10:00:00Z")
+	if !windows.IsOpen(now) {
+		t.Fail()
+	}
+
+	// Weeknights 1am to 3am Sydney time
+	windows = MaintenanceWindows{Timezone: "Australia/Sydney", Windows: []string{"* 1-2 * * 1-5"}}
+	if err := windows.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if windows.IsOpen(now) {
+		t.Fail()
+	}
+
+	// 2017-02-22 14:30 UTC is Thursday 1:30am in Sydney daylight time
+	open, _ := time.Parse(time.RFC3339, "2017-02-22T14:30:00Z")
+	if !windows.IsOpen(open) {
+		t.Fail()
+	}
+
+	next, ok := windows.NextOpen(now)
+	if !ok || !next.Equal(open.Add(-30 * time.Minute)) {
+		t.Error(next, ok)
+	}
+
+	if (MaintenanceWindows{Windows: []string{"nope"}}).Validate() == nil {
+		t.Fail()
+	}
+}
+
+func TestCronTriggerLatest(t *testing.T) {
+	// 2am every day in Sydney, 15:00 UTC during daylight time
+	trigger := CronTrigger{Expression: "0 2 * * *", Timezone: "Australia/Sydney"}
+	if err := trigger.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, _ := time.Parse(time.RFC3339, "2017-02-20T15:00:00Z")
+	now, _ := time.Parse(time.RFC3339, "2017-02-20T20:00:00Z")
+	if _, _, ok := trigger.Latest(after, now); ok {
+		t.Error("fired again at the time it last fired")
+	}
+
+	// Down for three days, only the latest firing is returned
+	now, _ = time.Parse(time.RFC3339, "2017-02-23T16:00:00Z")
+	latest, fired, ok := trigger.Latest(after, now)
+	expected, _ := time.Parse(time.RFC3339, "2017-02-23T15:00:00Z")
+	if !ok || fired != 3 || !latest.Equal(expected) {
+		t.Error(latest, fired, ok)
+	}
+
+	if (CronTrigger{Expression: "0 2 * *"}).Validate() == nil {
+		t.Fail()
+	}
+}
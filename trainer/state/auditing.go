@@ -280,6 +280,15 @@ func (db *OrcaDb) Query__HostLog(host string, limit string, search string, lastt
 	return results
 }
 
+func (db *OrcaDb) Query__AppHostLog(app string, host string, limit string, search string, lasttime string) []LogEvent {
+	if !db.enabled {
+		return []LogEvent{}
+	}
+	var results []LogEvent
+	db.query("logs", &results, host, app, limit, search, lasttime)
+	return results
+}
+
 func (db *OrcaDb) Query__AppLog(app string, limit string, search string, lasttime string) []LogEvent {
 	if !db.enabled {
 		return []LogEvent{}
@@ -0,0 +1,483 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"orca/trainer/logs"
+	"orca/trainer/model"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	JOB__RUNNING   = "running"
+	JOB__SUCCEEDED = "succeeded"
+	JOB__FAILED    = "failed"
+)
+
+/* Kept next to the configuration, like Cron.LastScheduleTime the job history has to outlive the trainer */
+const JOBS_FILE = "jobs.json"
+
+const (
+	RUN__PENDING   = "pending"
+	RUN__RUNNING   = "running"
+	RUN__SUCCEEDED = "succeeded"
+	RUN__FAILED    = "failed"
+)
+
+/* One attempt at the job on one host */
+type JobRun struct {
+	Id       string
+	HostId   string
+	State    string
+	ExitCode int
+	Started  time.Time
+	Finished time.Time
+	Reason   string
+}
+
+func (run *JobRun) IsActive() bool {
+	return run.State == RUN__PENDING || run.State == RUN__RUNNING
+}
+
+/* A single execution of a job app, the spec is copied so later edits do not change a job already going */
+type Job struct {
+	Id          string
+	Application string
+	Version     string
+	Spec        model.JobSpec
+	State       string
+	Reason      string
+	Created     time.Time
+	Finished    time.Time
+	Runs        []*JobRun
+
+	/* Set for cron jobs, the time the schedule fired */
+	Scheduled time.Time
+	Webhook   string
+}
+
+func (job *Job) IsFinished() bool {
+	return job.State != JOB__RUNNING
+}
+
+/* Runs still going, runs that succeeded and runs that failed */
+func (job *Job) Counts() (int, int, int) {
+	active, succeeded, failed := 0, 0, 0
+	for _, run := range job.Runs {
+		switch run.State {
+		case RUN__PENDING, RUN__RUNNING:
+			active += 1
+		case RUN__SUCCEEDED:
+			succeeded += 1
+		case RUN__FAILED:
+			failed += 1
+		}
+	}
+	return active, succeeded, failed
+}
+
+func (job *Job) ActiveRunOn(hostId string) *JobRun {
+	for _, run := range job.Runs {
+		if run.HostId == hostId && run.IsActive() {
+			return run
+		}
+	}
+	return nil
+}
+
+func (job *Job) PastDeadline(now time.Time) bool {
+	return job.Spec.Deadline > 0 && now.Sub(job.Created) > time.Duration(job.Spec.Deadline)*time.Second
+}
+
+type JobsByCreated []*Job
+
+func (s JobsByCreated) Len() int {
+	return len(s)
+}
+func (s JobsByCreated) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s JobsByCreated) Less(i, j int) bool {
+	if s[i].Created.Equal(s[j].Created) {
+		return s[i].Id < s[j].Id
+	}
+	return s[i].Created.Before(s[j].Created)
+}
+
+func (store *StateStore) AddJob(job *Job) {
+	store.jobs[job.Id] = job
+}
+
+func (store *StateStore) RemoveJob(id string) {
+	delete(store.jobs, id)
+}
+
+func (store *StateStore) GetJob(id string) (*Job, error) {
+	if job, ok := store.jobs[id]; ok {
+		return job, nil
+	}
+	return nil, errors.New("No such job")
+}
+
+/* Every job, oldest first */
+func (store *StateStore) ListOfJobs() []*Job {
+	ret := make([]*Job, 0)
+	for _, job := range store.jobs {
+		ret = append(ret, job)
+	}
+	sort.Sort(JobsByCreated(ret))
+	return ret
+}
+
+func (store *StateStore) ListOfApplicationJobs(application string) []*Job {
+	ret := make([]*Job, 0)
+	for _, job := range store.ListOfJobs() {
+		if job.Application == application {
+			ret = append(ret, job)
+		}
+	}
+	return ret
+}
+
+/* Writes the jobs and their runs when they changed since the last save */
+func (store *StateStore) SaveJobs() error {
+	path := store.configurationStore.SiblingPath(JOBS_FILE)
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(store.ListOfJobs(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, store.savedJobs) {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	store.savedJobs = data
+	return nil
+}
+
+/* Picks the job history back up after a restart, jobs that were still going carry on with the runs they had */
+func (store *StateStore) LoadJobs() error {
+	path := store.configurationStore.SiblingPath(JOBS_FILE)
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	jobs := make([]*Job, 0)
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		store.AddJob(job)
+	}
+	store.savedJobs = data
+	return nil
+}
+
+/* Starts a job for the apps latest published version, a job of the same app still going is failed as it is superseded */
+func (store *StateStore) StartJob(app *model.ApplicationConfiguration, id string, now time.Time) *Job {
+	for _, job := range store.ListOfApplicationJobs(app.Name) {
+		if !job.IsFinished() {
+			store.finishJob(job, JOB__FAILED, fmt.Sprintf("superseded by job %s", id), now)
+		}
+	}
+	return store.startJob(app, id, now)
+}
+
+func (store *StateStore) startJob(app *model.ApplicationConfiguration, id string, now time.Time) *Job {
+	job := &Job{
+		Id:          id,
+		Application: app.Name,
+		Version:     app.GetLatestPublishedVersion(),
+		Spec:        app.Job,
+		State:       JOB__RUNNING,
+		Created:     now,
+		Runs:        make([]*JobRun, 0),
+		Webhook:     app.Cron.FailureWebhook,
+	}
+	store.AddJob(job)
+
+	Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__INFO,
+		Message: fmt.Sprintf("JOB: Started job %s for application %s version %s", job.Id, job.Application, job.Version),
+		AppId:   job.Application,
+	})
+	return job
+}
+
+/* Called when the add_application for a run goes out to the host */
+func (store *StateStore) AddJobRun(jobId string, hostId string, runId string, now time.Time) {
+	job, err := store.GetJob(jobId)
+	if err != nil {
+		return
+	}
+
+	job.Runs = append(job.Runs, &JobRun{Id: runId, HostId: hostId, State: RUN__PENDING, Started: now})
+}
+
+func (store *StateStore) finishJob(job *Job, jobState string, reason string, now time.Time) {
+	job.State = jobState
+	job.Reason = reason
+	job.Finished = now
+
+	for _, run := range job.Runs {
+		if run.IsActive() {
+			run.State = RUN__FAILED
+			run.Reason = reason
+			run.Finished = now
+		}
+	}
+
+	message := fmt.Sprintf("JOB: Job %s for application %s %s, %s", job.Id, job.Application, jobState, reason)
+	if jobState == JOB__FAILED {
+		Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__ERROR, Message: message, AppId: job.Application})
+		store.notifyWebhook(job.Webhook, message)
+		return
+	}
+	Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__INFO, Message: message, AppId: job.Application})
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+/*
+	Same body as the audit webhooks, so the same receivers can take it.
+	Sent in the background, a slow receiver must not hold up the planner loop or a host checkin.
+*/
+func (store *StateStore) notifyWebhook(uri string, message string) {
+	if uri == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{"text": "orca@" + store.configurationStore.GlobalSettings.EnvName + " said " + message})
+	go func() {
+		res, err := webhookClient.Post(uri, "application/json; charset=utf-8", bytes.NewBuffer(body))
+		if err != nil {
+			logs.AuditLogger.Errorf("Could not send job failure to webhook: %+v", err)
+			return
+		}
+		res.Body.Close()
+	}()
+}
+
+func (store *StateStore) settleJob(job *Job, now time.Time) {
+	if job.IsFinished() {
+		return
+	}
+
+	_, succeeded, failed := job.Counts()
+	if succeeded >= job.Spec.NeededCompletions() {
+		store.finishJob(job, JOB__SUCCEEDED, fmt.Sprintf("%d runs completed", succeeded), now)
+	} else if failed > job.Spec.RetryLimit {
+		store.finishJob(job, JOB__FAILED, fmt.Sprintf("%d runs failed, the retry limit is %d", failed, job.Spec.RetryLimit), now)
+	}
+}
+
+func (store *StateStore) finishRun(job *Job, run *JobRun, runState string, reason string, now time.Time) {
+	run.State = runState
+	run.Reason = reason
+	run.Finished = now
+
+	severity := AUDIT__INFO
+	if runState == RUN__FAILED {
+		severity = AUDIT__ERROR
+	}
+	Audit.Insert__AuditEvent(AuditEvent{Severity: severity,
+		Message: fmt.Sprintf("JOB: Run %s of job %s on host %s %s, %s", run.Id, job.Id, run.HostId, runState, reason),
+		AppId:   job.Application,
+		HostId:  run.HostId,
+	})
+	store.settleJob(job, now)
+}
+
+/* Picks up what a host reported about a job app at checkin */
+func (store *StateStore) updateJobRuns(hostId string, application model.Application, now time.Time) {
+	for _, job := range store.ListOfApplicationJobs(application.Name) {
+		run := job.ActiveRunOn(hostId)
+		if run == nil || job.IsFinished() {
+			continue
+		}
+
+		switch application.State {
+		case "running":
+			run.State = RUN__RUNNING
+		case "exited":
+			run.ExitCode = application.ExitCode
+			if application.ExitCode == 0 {
+				store.finishRun(job, run, RUN__SUCCEEDED, "exited with code 0", now)
+			} else {
+				store.finishRun(job, run, RUN__FAILED, fmt.Sprintf("exited with code %d", application.ExitCode), now)
+			}
+		case "failed", "checks_failed":
+			store.finishRun(job, run, RUN__FAILED, "the container failed to start", now)
+		}
+	}
+}
+
+/* Fails jobs past their deadline, and runs whose host has gone away or whose change timed out */
+func (store *StateStore) UpdateJobs(now time.Time) {
+	for _, job := range store.ListOfJobs() {
+		if job.IsFinished() {
+			continue
+		}
+
+		if job.PastDeadline(now) {
+			store.finishJob(job, JOB__FAILED, fmt.Sprintf("the deadline of %d seconds passed", job.Spec.Deadline), now)
+			continue
+		}
+
+		for _, run := range job.Runs {
+			if !run.IsActive() {
+				continue
+			}
+
+			host, err := store.GetConfiguration(run.HostId)
+			if err != nil || host.State == "terminating" {
+				store.finishRun(job, run, RUN__FAILED, "the host went away", now)
+				continue
+			}
+
+			/* The run id is the id of its add_application change, once that is gone the app should be on the host */
+			if run.State == RUN__PENDING && host.GetChange(run.Id) == nil && !host.HasApp(job.Application) {
+				store.finishRun(job, run, RUN__FAILED, "the application change did not apply", now)
+			}
+		}
+	}
+}
+
+/*
+	Starts the job of every cron job app whose schedule fired since its LastScheduleTime. Only the latest of several
+	missed firings is run. Returns true when a LastScheduleTime moved and the configuration needs saving.
+*/
+func (store *StateStore) ScheduleCronJobs(now time.Time) bool {
+	changed := false
+	for _, app := range store.configurationStore.ApplicationConfigurations {
+		if !app.IsCronJob() || !app.Enabled || app.GetLatestPublishedConfiguration() == nil {
+			continue
+		}
+
+		/* A new schedule starts counting from now, it does not owe any runs */
+		if app.Cron.LastScheduleTime.IsZero() {
+			app.Cron.LastScheduleTime = now
+			changed = true
+			continue
+		}
+
+		scheduled, fired, ok := app.Cron.Trigger().Latest(app.Cron.LastScheduleTime, now)
+		if !ok {
+			continue
+		}
+		app.Cron.LastScheduleTime = scheduled
+		changed = true
+
+		if fired > 1 {
+			Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__INFO,
+				Message: fmt.Sprintf("CRON: %d runs of application %s were missed, starting only the one due at %s", fired, app.Name, scheduled.Format(time.RFC3339)),
+				AppId:   app.Name,
+			})
+		}
+
+		if app.Cron.StartingDeadline > 0 && now.Sub(scheduled) > time.Duration(app.Cron.StartingDeadline)*time.Second {
+			message := fmt.Sprintf("CRON: The run of application %s due at %s missed its starting deadline of %d seconds", app.Name, scheduled.Format(time.RFC3339), app.Cron.StartingDeadline)
+			Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__ERROR, Message: message, AppId: app.Name})
+			store.notifyWebhook(app.Cron.FailureWebhook, message)
+			continue
+		}
+
+		store.triggerCronJob(app, scheduled, now)
+	}
+
+	for _, app := range store.configurationStore.ApplicationConfigurations {
+		if app.IsCronJob() {
+			store.pruneJobHistory(app)
+		}
+	}
+	return changed
+}
+
+/* Applies the concurrency policy against the jobs of the app still going, nil when the run is skipped */
+func (store *StateStore) triggerCronJob(app *model.ApplicationConfiguration, scheduled time.Time, now time.Time) *Job {
+	id := fmt.Sprintf("%s-%d", app.Name, scheduled.Unix())
+	active := make([]*Job, 0)
+	for _, job := range store.ListOfApplicationJobs(app.Name) {
+		if !job.IsFinished() {
+			active = append(active, job)
+		}
+	}
+
+	switch app.Cron.Concurrency() {
+	case model.CONCURRENCY__FORBID:
+		if len(active) > 0 {
+			Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__INFO,
+				Message: fmt.Sprintf("CRON: Skipped the run of application %s due at %s, job %s is still going", app.Name, scheduled.Format(time.RFC3339), active[0].Id),
+				AppId:   app.Name,
+			})
+			return nil
+		}
+	case model.CONCURRENCY__REPLACE:
+		for _, job := range active {
+			store.finishJob(job, JOB__FAILED, fmt.Sprintf("replaced by job %s", id), now)
+		}
+	}
+
+	job := store.startJob(app, id, now)
+	job.Scheduled = scheduled
+	return job
+}
+
+/* Keeps the newest finished jobs of a cron job app up to its history limits */
+func (store *StateStore) pruneJobHistory(app *model.ApplicationConfiguration) {
+	jobs := store.ListOfApplicationJobs(app.Name)
+	succeeded, failed := 0, 0
+	for i := len(jobs) - 1; i >= 0; i-- {
+		switch jobs[i].State {
+		case JOB__SUCCEEDED:
+			succeeded += 1
+			if succeeded > app.Cron.SuccessfulHistory() {
+				store.RemoveJob(jobs[i].Id)
+			}
+		case JOB__FAILED:
+			failed += 1
+			if failed > app.Cron.FailedHistory() {
+				store.RemoveJob(jobs[i].Id)
+			}
+		}
+	}
+}
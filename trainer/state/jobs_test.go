@@ -0,0 +1,179 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleCronJobs_Concurrency(t *testing.T) {
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+
+	stateStore := StateStore{}
+	stateStore.Init(&config)
+
+	versionConfig := make(map[string]*model.VersionConfig)
+	versionConfig["1"] = &model.VersionConfig{Version: "1"}
+	app := config.Add("job1", &model.ApplicationConfiguration{
+		Name:            "job1",
+		Type:            model.APPLICATION__JOB,
+		Job:             model.JobSpec{Completions: 3, Parallelism: 2, RetryLimit: 1},
+		PublishedConfig: versionConfig,
+		Enabled:         true,
+		Cron:            model.CronJobPolicy{Schedule: "*/10 * * * *", ConcurrencyPolicy: model.CONCURRENCY__FORBID, SuccessfulHistoryLimit: 1},
+	})
+	job := stateStore.StartJob(app, "job-1", time.Now())
+
+	now, _ := time.Parse(time.RFC3339, "2017-02-22T10:00:00Z")
+	if !stateStore.ScheduleCronJobs(now) || !app.Cron.LastScheduleTime.Equal(now) || len(stateStore.ListOfJobs()) != 1 {
+		t.Fatalf("a new schedule should start counting from now %+v", app.Cron)
+	}
+
+	/* Forbid skips the run while the published job is still going */
+	now = now.Add(10 * time.Minute)
+	if !stateStore.ScheduleCronJobs(now) || len(stateStore.ListOfJobs()) != 1 {
+		t.Errorf("%+v", stateStore.ListOfJobs())
+	}
+
+	/* Replace fails the old job and starts the new one */
+	app.Cron.ConcurrencyPolicy = model.CONCURRENCY__REPLACE
+	now = now.Add(10 * time.Minute)
+	stateStore.ScheduleCronJobs(now)
+	if job.State != JOB__FAILED || len(stateStore.ListOfJobs()) != 2 {
+		t.Fatalf("%s %+v", job.State, stateStore.ListOfJobs())
+	}
+	replacement, err := stateStore.GetJob(fmt.Sprintf("job1-%d", now.Unix()))
+	if err != nil || !replacement.Scheduled.Equal(now) || replacement.IsFinished() {
+		t.Fatalf("%+v %v", replacement, err)
+	}
+
+	/* Allow runs alongside, and missed firings after a restart only start the latest */
+	app.Cron.ConcurrencyPolicy = model.CONCURRENCY__ALLOW
+	now = now.Add(35 * time.Minute)
+	stateStore.ScheduleCronJobs(now)
+	if !app.Cron.LastScheduleTime.Equal(now.Add(-5*time.Minute)) || len(stateStore.ListOfApplicationJobs("job1")) != 3 || replacement.IsFinished() {
+		t.Errorf("%+v %+v", app.Cron, stateStore.ListOfJobs())
+	}
+
+	/* Too late to start, the run is dropped and the failure webhook told */
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	app.Cron.StartingDeadline = 60
+	app.Cron.FailureWebhook = server.URL
+	now = now.Add(13 * time.Minute)
+	stateStore.ScheduleCronJobs(now)
+	if len(stateStore.ListOfApplicationJobs("job1")) != 3 {
+		t.Errorf("%+v", stateStore.ListOfJobs())
+	}
+
+	select {
+	case body := <-received:
+		if !strings.Contains(body, "missed its starting deadline") {
+			t.Error(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("webhook was not sent")
+	}
+
+	/* Only the newest finished job of each outcome is kept */
+	for _, active := range stateStore.ListOfApplicationJobs("job1") {
+		if !active.IsFinished() {
+			active.State = JOB__SUCCEEDED
+		}
+	}
+	stateStore.ScheduleCronJobs(now)
+	kept := make(map[string]int)
+	for _, finished := range stateStore.ListOfApplicationJobs("job1") {
+		kept[finished.State] += 1
+	}
+	if kept[JOB__FAILED] != 1 || kept[JOB__SUCCEEDED] != 1 || len(kept) != 2 {
+		t.Errorf("%+v", kept)
+	}
+}
+
+func TestSaveJobs_SurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := configuration.ConfigurationStore{}
+	config.Init(filepath.Join(dir, "trainer.conf"))
+
+	stateStore := StateStore{}
+	stateStore.Init(&config)
+
+	versionConfig := make(map[string]*model.VersionConfig)
+	versionConfig["1"] = &model.VersionConfig{Version: "1"}
+	app := config.Add("job1", &model.ApplicationConfiguration{
+		Name:            "job1",
+		Type:            model.APPLICATION__JOB,
+		Job:             model.JobSpec{Completions: 2, Parallelism: 1},
+		PublishedConfig: versionConfig,
+		Enabled:         true,
+	})
+
+	now, _ := time.Parse(time.RFC3339, "2017-02-22T10:00:00Z")
+	finished := stateStore.StartJob(app, "job-1", now)
+	stateStore.finishJob(finished, JOB__SUCCEEDED, "2 runs completed", now.Add(time.Minute))
+	running := stateStore.StartJob(app, "job-2", now.Add(2*time.Minute))
+	stateStore.AddJobRun(running.Id, "host1", "change-1", now.Add(2*time.Minute))
+	if err := stateStore.SaveJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* A restarted trainer has the same history, and the running job still knows its run */
+	restarted := StateStore{}
+	restarted.Init(&config)
+	if err := restarted.LoadJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := restarted.ListOfJobs()
+	if len(jobs) != 2 || jobs[0].Id != "job-1" || jobs[0].State != JOB__SUCCEEDED || !jobs[0].Finished.Equal(now.Add(time.Minute)) {
+		t.Fatalf("%+v", jobs)
+	}
+	if jobs[1].State != JOB__RUNNING || jobs[1].ActiveRunOn("host1") == nil || jobs[1].Spec.Completions != 2 {
+		t.Errorf("%+v", jobs[1])
+	}
+
+	/* Nothing is written again until something changes */
+	os.Remove(config.SiblingPath(JOBS_FILE))
+	restarted.SaveJobs()
+	if _, err := os.Stat(config.SiblingPath(JOBS_FILE)); err == nil {
+		t.Error("unchanged jobs were written again")
+	}
+}
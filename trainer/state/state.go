@@ -23,17 +23,101 @@ import (
 	"fmt"
 	"orca/trainer/configuration"
 	"orca/trainer/model"
+	"sort"
 	"time"
 )
 
+/* Startup times kept per app to learn its pre-scale lead time from */
+const STARTUP_SAMPLES = 10
+
 type StateStore struct {
 	hosts              map[string]*model.Host
 	configurationStore *configuration.ConfigurationStore
+
+	/* When capacity was asked for, keyed by host and app, until the app reports running */
+	startsPending  map[string]time.Time
+	startupSamples map[string][]time.Duration
+
+	jobs map[string]*Job
+
+	/* What SaveJobs last wrote, so an unchanged history is not written again every tick */
+	savedJobs []byte
 }
 
 func (store *StateStore) Init(configurationStore *configuration.ConfigurationStore) {
 	store.configurationStore = configurationStore
 	store.hosts = make(map[string]*model.Host)
+	store.startsPending = make(map[string]time.Time)
+	store.startupSamples = make(map[string][]time.Duration)
+	store.jobs = make(map[string]*Job)
+}
+
+/*
+	An app started on a server launched for it is timed from when the server was asked for,
+	so learned lead times cover booting the server as well as starting the app.
+*/
+func (store *StateStore) startTimingApp(host *model.Host, change *model.ChangeApplication) {
+	started, err := time.Parse(time.RFC3339Nano, change.Time)
+	if err != nil {
+		return
+	}
+
+	if requested, err := time.Parse(time.RFC3339Nano, host.Requested); err == nil && requested.Before(started) {
+		started = requested
+	}
+	host.Requested = ""
+
+	store.expireTimingApps(time.Now())
+	store.startsPending[host.Id+"/"+change.Name] = started
+}
+
+/* A server launch and the app change both timing out is the longest a start can take, anything slower did not really start */
+func (store *StateStore) maxStartTime() time.Duration {
+	settings := store.configurationStore.GlobalSettings
+	return time.Duration(settings.ServerChangeTimeout+settings.AppChangeTimeout) * time.Second
+}
+
+/* Forgets starts that went over maxStartTime, the app never came up and should not be learned from */
+func (store *StateStore) expireTimingApps(now time.Time) {
+	for key, started := range store.startsPending {
+		if now.Sub(started) > store.maxStartTime() {
+			delete(store.startsPending, key)
+		}
+	}
+}
+
+/* The app failed to start, so there is nothing to learn from it */
+func (store *StateStore) dropTimingApp(hostId string, application string) {
+	delete(store.startsPending, hostId+"/"+application)
+}
+
+/* Records how long the app took to run and keeps the longest recent start as its learned lead time */
+func (store *StateStore) finishTimingApp(host *model.Host, appConfiguration *model.ApplicationConfiguration) {
+	key := host.Id + "/" + appConfiguration.Name
+	started, ok := store.startsPending[key]
+	if !ok {
+		return
+	}
+	delete(store.startsPending, key)
+
+	sample := time.Now().Sub(started)
+	if sample > store.maxStartTime() {
+		return
+	}
+
+	samples := append(store.startupSamples[appConfiguration.Name], sample)
+	if len(samples) > STARTUP_SAMPLES {
+		samples = samples[len(samples)-STARTUP_SAMPLES:]
+	}
+	store.startupSamples[appConfiguration.Name] = samples
+
+	var longest time.Duration
+	for _, sample := range samples {
+		if sample > longest {
+			longest = sample
+		}
+	}
+	appConfiguration.PreScale.LearnedLeadTime = int64(longest / time.Second)
 }
 
 func (store *StateStore) Add(hostId string, host *model.Host) {
@@ -95,6 +179,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 						HostId:  hostId,
 						AppId:   changeObject.Name,
 					})
+					store.startTimingApp(host, changeObject)
 
 				} else if changeObject.Type == "remove_application" {
 					Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__INFO,
@@ -152,6 +237,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 						})
 
 						appConfigurationVersion.DeploymentSuccess += 1
+						store.finishTimingApp(host, appConfiguration)
 					} else if appStateFromHost.Application.State == "failed" {
 						Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__ERROR,
 							Message: fmt.Sprintf("Application %s on host %s has failed, docker is reporting the container is no longer active",
@@ -161,6 +247,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 						})
 
 						appConfigurationVersion.DeploymentFailures += 1
+						store.dropTimingApp(hostId, appStateFromHost.Name)
 					} else if appStateFromHost.Application.State == "checks_failed" {
 						Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__ERROR,
 							Message: fmt.Sprintf("Application %s on host %s has failed, the application checks have failed",
@@ -169,6 +256,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 							AppId:  appStateFromHost.Name,
 						})
 						appConfigurationVersion.DeploymentFailures += 1
+						store.dropTimingApp(hostId, appStateFromHost.Name)
 					}
 				}
 			}
@@ -189,6 +277,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 					AppId:  appStateFromHost.Name,
 				})
 				appConfigurationVersion.DeploymentSuccess += 1
+				store.finishTimingApp(host, appConfiguration)
 
 			} else if appStateFromHost.Application.State == "failed" {
 				Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__ERROR,
@@ -198,6 +287,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 					AppId:  appStateFromHost.Name,
 				})
 				appConfigurationVersion.DeploymentFailures += 1
+				store.dropTimingApp(hostId, appStateFromHost.Name)
 
 			} else if appStateFromHost.Application.State == "checks_failed" {
 				Audit.Insert__AuditEvent(AuditEvent{Severity: AUDIT__ERROR,
@@ -208,6 +298,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 				})
 
 				appConfigurationVersion.DeploymentFailures += 1
+				store.dropTimingApp(hostId, appStateFromHost.Name)
 			}
 		}
 	}
@@ -215,6 +306,7 @@ func (store *StateStore) HostCheckin(hostId string, checkin model.HostCheckinDat
 	host.Apps = make([]model.Application, 0)
 	for _, appStateFromHost := range checkin.State {
 		host.Apps = append(host.Apps, appStateFromHost.Application)
+		store.updateJobRuns(hostId, appStateFromHost.Application, time.Now())
 	}
 	return store.GetConfiguration(hostId)
 }
@@ -244,11 +336,35 @@ func (store *StateStore) RemoveHost(hostId string) {
 	delete(store.hosts, hostId)
 }
 
+type HostsById []*model.Host
+
+func (s HostsById) Len() int {
+	return len(s)
+}
+func (s HostsById) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s HostsById) Less(i, j int) bool {
+	return s[i].Id < s[j].Id
+}
+
+/* Running hosts ordered by id, so walking them gives the same result every time */
 func (store *StateStore) ListOfHosts() []*model.Host {
 	hosts := make([]*model.Host, 0)
 	for _, host := range store.GetAllRunningHosts() {
 		hosts = append(hosts, host)
 	}
 
+	sort.Sort(HostsById(hosts))
+	return hosts
+}
+
+func (store *StateStore) ListOfAllHosts() []*model.Host {
+	hosts := make([]*model.Host, 0)
+	for _, host := range store.hosts {
+		hosts = append(hosts, host)
+	}
+
+	sort.Sort(HostsById(hosts))
 	return hosts
 }
@@ -0,0 +1,72 @@
+/*
+Copyright Alex Mack (al9mack@gmail.com) and Michael Lawson (michael@sphinix.com)
+This file is part of Orca.
+
+Orca is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Orca is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Orca.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"orca/trainer/configuration"
+	"orca/trainer/model"
+	"testing"
+	"time"
+)
+
+func TestHostCheckin_LearnsLeadTimeFromGoodStarts(t *testing.T) {
+	config := configuration.ConfigurationStore{}
+	config.Init("")
+
+	stateStore := StateStore{}
+	stateStore.Init(&config)
+
+	versionConfig := make(map[string]*model.VersionConfig)
+	versionConfig["1"] = &model.VersionConfig{Version: "1"}
+	app := config.Add("app1", &model.ApplicationConfiguration{Name: "app1", PublishedConfig: versionConfig, PreScale: model.PreScalePolicy{Learn: true}})
+	stateStore.Add("host1", &model.Host{Id: "host1", State: "running"})
+
+	/* The host applies an add_application asked for a while ago, then reports the app in the given state */
+	start := func(id string, ago time.Duration, appState string) {
+		host := stateStore.GetAllHosts()["host1"]
+		host.Changes = []model.ChangeApplication{{Id: id, Type: "add_application", HostId: "host1", Name: "app1", Time: time.Now().Add(-ago).Format(time.RFC3339Nano)}}
+		stateStore.HostCheckin("host1", model.HostCheckinDataPackage{
+			ChangesApplied: map[string]bool{id: true},
+			State:          []model.ApplicationStateFromHost{{Name: "app1", Application: model.Application{Name: "app1", Version: "1", State: "installing"}}},
+		})
+		stateStore.HostCheckin("host1", model.HostCheckinDataPackage{
+			State: []model.ApplicationStateFromHost{{Name: "app1", Application: model.Application{Name: "app1", Version: "1", State: appState}}},
+		})
+	}
+
+	start("change1", time.Minute, "running")
+	if app.PreScale.LearnedLeadTime != 60 {
+		t.Fatal(app.PreScale.LearnedLeadTime)
+	}
+
+	/* Longer than a server launch and app change can take, not a start worth learning from */
+	start("change2", 2*time.Hour, "running")
+	if app.PreScale.LearnedLeadTime != 60 {
+		t.Error(app.PreScale.LearnedLeadTime)
+	}
+
+	/* A failed start is forgotten, it does not count once the app does come up */
+	start("change3", 3*time.Minute, "failed")
+	stateStore.HostCheckin("host1", model.HostCheckinDataPackage{
+		State: []model.ApplicationStateFromHost{{Name: "app1", Application: model.Application{Name: "app1", Version: "1", State: "running"}}},
+	})
+	if app.PreScale.LearnedLeadTime != 60 || len(stateStore.startsPending) != 0 {
+		t.Error(app.PreScale.LearnedLeadTime, stateStore.startsPending)
+	}
+}
@@ -199,6 +199,21 @@ func (db *StatisticsDb) Query__ApplicationUtilisationStatistic(application strin
 	return results
 }
 
+func (db *StatisticsDb) Query__ApplicationUtilisationStatisticSince(application string, since time.Time) []ApplicationUtilisationStatistic {
+	s := db.session.Copy()
+	defer s.Close()
+
+	c := s.DB("orca").C("app_utilisation")
+	var results []ApplicationUtilisationStatistic
+	err := c.Find(bson.M{"appname": application, "timestamp": bson.M{"$gt": since}}).Sort("-timestamp").All(&results)
+	if err != nil {
+		logs.AuditLogger.Errorln(err)
+		return []ApplicationUtilisationStatistic{}
+	}
+
+	return results
+}
+
 func (db *StatisticsDb) Query__HostUtilisationStatistic(host string) []HostUtilisationStatistic {
 	s := db.session.Copy()
 	defer s.Close()